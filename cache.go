@@ -0,0 +1,185 @@
+package finalize
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/coredns/coredns/plugin/metrics"
+	"github.com/coredns/coredns/plugin/pkg/cache"
+	"github.com/miekg/dns"
+)
+
+const defaultCacheMaxTTL = time.Hour
+
+// chainCache stores the terminal records of already resolved CNAME targets,
+// so repeated queries for the same target skip the hop-by-hop walk.
+type chainCache struct {
+	items  *cache.Cache[*cacheItem]
+	maxTTL time.Duration
+	// stale is how long entries are kept once expired, so they can be
+	// served stale.
+	stale time.Duration
+	// prefetch is the number of hits after which an entry is refreshed in
+	// the background, once no more than prefetchPercent of its lifetime is
+	// left. Zero disables prefetching.
+	prefetch        uint32
+	prefetchPercent int
+	now             func() time.Time
+}
+
+// cacheItem is a resolved chain tail: the terminal records owned by the last
+// target and the TTLs seen while walking from name to that target. ttl is the
+// lifetime of the entry, the minimum TTL capped by the maximum cache TTL.
+type cacheItem struct {
+	name  string
+	qtype uint16
+	// subnet is the client subnet the tail was resolved for, the empty
+	// string if the answers are valid for all clients.
+	subnet  string
+	answers []dns.RR
+	ttl     uint32
+	ttls    chainTTLs
+	// chain are the aliases from name to the answers.
+	chain []chainHop
+	// authenticated is set if all lookups of the tail had the AD bit set,
+	// signed if any of them was signed.
+	authenticated bool
+	signed        bool
+	added         time.Time
+	expires       time.Time
+	// usage is shared by all copies of a stored entry.
+	usage *cacheUsage
+}
+
+// cacheUsage tracks the hits of a cache entry and whether it is being
+// prefetched.
+type cacheUsage struct {
+	hits        atomic.Uint32
+	prefetching atomic.Bool
+}
+
+func newChainCache(size int, maxTTL time.Duration) *chainCache {
+	return &chainCache{
+		items:  cache.New[*cacheItem](size),
+		maxTTL: maxTTL,
+		now:    time.Now,
+	}
+}
+
+func cacheKey(name string, qtype uint16, subnet string) uint64 {
+	return cache.Hash([]byte(strings.ToLower(name) + "/" + dns.Type(qtype).String() + "/" + subnet))
+}
+
+// get returns the cached tail for name and qtype, resolved for a scope
+// containing the client subnet, or valid for all clients. The TTL of the
+// returned item is the remaining lifetime of the entry and its chain TTLs are
+// reduced by the time spent in the cache.
+func (c *chainCache) get(ctx context.Context, name string, qtype uint16, subnet *dns.EDNS0_SUBNET) (*cacheItem, bool) {
+	now := c.now()
+	for _, subnet := range subnetKeys(subnet) {
+		if item, ok := c.fetch(name, qtype, subnet, now); ok {
+			cacheHitCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+			return item, true
+		}
+	}
+
+	cacheMissCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+	return nil, false
+}
+
+func (c *chainCache) fetch(name string, qtype uint16, subnet string, now time.Time) (*cacheItem, bool) {
+	item, ok := c.lookup(name, qtype, subnet, now)
+	if !ok || !now.Before(item.expires) {
+		return nil, false
+	}
+	item.usage.hits.Add(1)
+
+	remaining := *item
+	remaining.ttl = uint32(item.expires.Sub(now).Seconds())
+	if remaining.ttl == 0 {
+		remaining.ttl = 1
+	}
+	elapsed := uint32(now.Sub(item.added).Seconds())
+	remaining.ttls = item.ttls.decay(elapsed)
+	remaining.ttls.min = remaining.ttl
+	remaining.chain = make([]chainHop, len(item.chain))
+	for i, hop := range item.chain {
+		hop.ttl = decayTTL(hop.ttl, elapsed)
+		remaining.chain[i] = hop
+	}
+	return &remaining, true
+}
+
+// getStale returns the cached tail for name and qtype like get, but also if
+// it has expired no longer ago than the configured staleness. The TTL of the
+// returned item is left to the caller.
+func (c *chainCache) getStale(name string, qtype uint16, subnet *dns.EDNS0_SUBNET) (*cacheItem, bool) {
+	now := c.now()
+	for _, subnet := range subnetKeys(subnet) {
+		if item, ok := c.lookup(name, qtype, subnet, now); ok {
+			stale := *item
+			return &stale, true
+		}
+	}
+	return nil, false
+}
+
+// lookup returns the entry for name, qtype and subnet, unless it expired
+// longer ago than the configured staleness. Such entries are removed.
+func (c *chainCache) lookup(name string, qtype uint16, subnet string, now time.Time) (*cacheItem, bool) {
+	key := cacheKey(name, qtype, subnet)
+	item, ok := c.items.Get(key)
+	if !ok || item.qtype != qtype || item.subnet != subnet || !strings.EqualFold(item.name, name) {
+		return nil, false
+	}
+	if !now.Before(item.expires.Add(c.stale)) {
+		c.items.Remove(key)
+		return nil, false
+	}
+	return item, true
+}
+
+// prefetchDue reports whether the entry item was taken from should be
+// prefetched, and if so, marks it as being prefetched. An entry is prefetched
+// once it has been hit often enough and little of its lifetime is left.
+func (c *chainCache) prefetchDue(item *cacheItem) bool {
+	if c.prefetch == 0 || item.usage.hits.Load() < c.prefetch {
+		return false
+	}
+	lifetime := item.expires.Sub(item.added)
+	if item.expires.Sub(c.now())*100 > lifetime*time.Duration(c.prefetchPercent) {
+		return false
+	}
+	return item.usage.prefetching.CompareAndSwap(false, true)
+}
+
+// set stores the tail item, keyed by its name, qtype and subnet. Entries live for the
+// minimum of the chain TTLs of the item, capped by the configured maximum; a
+// TTL of 0 is not cached.
+func (c *chainCache) set(ctx context.Context, item *cacheItem) {
+	ttl := item.ttls.min
+	if ttl == 0 || len(item.answers) == 0 {
+		return
+	}
+	lifetime := time.Duration(ttl) * time.Second
+	if c.maxTTL > 0 && lifetime > c.maxTTL {
+		lifetime = c.maxTTL
+		ttl = uint32(c.maxTTL.Seconds())
+	}
+
+	stored := *item
+	stored.answers = make([]dns.RR, 0, len(item.answers))
+	for _, rr := range item.answers {
+		stored.answers = append(stored.answers, dns.Copy(rr))
+	}
+	now := c.now()
+	stored.ttl = ttl
+	stored.added = now
+	stored.expires = now.Add(lifetime)
+	stored.usage = new(cacheUsage)
+	if c.items.Add(cacheKey(item.name, item.qtype, item.subnet), &stored) {
+		cacheEvictionCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+	}
+}
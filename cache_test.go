@@ -0,0 +1,125 @@
+package finalize
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
+)
+
+func TestChainCacheExpiry(t *testing.T) {
+	now := time.Now()
+	c := newChainCache(100, time.Hour)
+	c.now = func() time.Time { return now }
+
+	answers := []dns.RR{
+		&dns.A{
+			Hdr: dns.RR_Header{Name: "baz.example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("203.0.113.10"),
+		},
+	}
+	c.set(context.Background(), &cacheItem{name: "bar.example.", qtype: dns.TypeA, answers: answers, ttls: chainTTLs{seen: true, min: 60, max: 60, last: 60}})
+
+	if _, ok := c.get(context.Background(), "bar.example.", dns.TypeAAAA, nil); ok {
+		t.Fatal("expected no cached entry for AAAA")
+	}
+
+	now = now.Add(20 * time.Second)
+	item, ok := c.get(context.Background(), "BAR.example.", dns.TypeA, nil)
+	if !ok {
+		t.Fatal("expected cached entry for bar.example.")
+	}
+	if item.ttl != 40 {
+		t.Fatalf("expected remaining TTL 40, got %d", item.ttl)
+	}
+	if len(item.answers) != 1 {
+		t.Fatalf("expected one cached answer, got %d", len(item.answers))
+	}
+
+	now = now.Add(40 * time.Second)
+	if _, ok := c.get(context.Background(), "bar.example.", dns.TypeA, nil); ok {
+		t.Fatal("expected cached entry to be expired")
+	}
+}
+
+func TestChainCacheMaxTTL(t *testing.T) {
+	now := time.Now()
+	c := newChainCache(100, 30*time.Second)
+	c.now = func() time.Time { return now }
+
+	answers := []dns.RR{
+		&dns.A{
+			Hdr: dns.RR_Header{Name: "baz.example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600},
+			A:   net.ParseIP("203.0.113.10"),
+		},
+	}
+	c.set(context.Background(), &cacheItem{name: "bar.example.", qtype: dns.TypeA, answers: answers, ttls: chainTTLs{seen: true, min: 3600, max: 3600, last: 3600}})
+
+	item, ok := c.get(context.Background(), "bar.example.", dns.TypeA, nil)
+	if !ok {
+		t.Fatal("expected cached entry for bar.example.")
+	}
+	if item.ttl != 30 {
+		t.Fatalf("expected TTL capped to 30, got %d", item.ttl)
+	}
+
+	c.set(context.Background(), &cacheItem{name: "zero.example.", qtype: dns.TypeA, answers: answers, ttls: chainTTLs{seen: true, min: 0, max: 0, last: 0}})
+	if _, ok := c.get(context.Background(), "zero.example.", dns.TypeA, nil); ok {
+		t.Fatal("expected zero TTL answers not to be cached")
+	}
+}
+
+func TestFinalizeUsesCache(t *testing.T) {
+	capture := &captureHandler{}
+	cfg := &dnsserver.Config{
+		Zone:        ".",
+		ListenHosts: []string{""},
+		Port:        "53",
+		Plugin: []plugin.Plugin{
+			func(next plugin.Handler) plugin.Handler {
+				return capture
+			},
+		},
+	}
+	server, err := dnsserver.NewServer("dns://:53", []*dnsserver.Config{cfg})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	finalize := New()
+	finalize.cache = newChainCache(100, time.Hour)
+	finalize.Next = cnameHandler{}
+
+	ctx := context.WithValue(context.Background(), dnsserver.Key{}, server)
+	ctx = context.WithValue(ctx, dnsserver.LoopKey{}, 0)
+
+	for i := 0; i < 2; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("foo.example.", dns.TypeA)
+		req.RecursionDesired = true
+
+		w := newCaptureResponseWriter()
+		_, err = finalize.ServeDNS(ctx, w, req)
+		if err != nil {
+			t.Fatalf("finalize ServeDNS failed: %v", err)
+		}
+		if w.msg == nil {
+			t.Fatal("expected finalize to write a response")
+		}
+		if countRRType(w.msg.Answer, dns.TypeA) != 1 || countRRType(w.msg.Answer, dns.TypeCNAME) != 0 {
+			t.Fatalf("expected one flattened A record, got: %#v", w.msg.Answer)
+		}
+		if got := w.msg.Answer[0].Header().Name; got != "foo.example." {
+			t.Fatalf("expected answer name to be foo.example., got %q", got)
+		}
+	}
+
+	// The second query must be answered from the cache without any upstream lookup.
+	if len(capture.got) != 2 {
+		t.Fatalf("expected two upstream lookups in total, got %d", len(capture.got))
+	}
+}
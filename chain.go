@@ -0,0 +1,171 @@
+package finalize
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// chainLink is the part of an alias chain that could be linked within a
+// single answer section.
+type chainLink struct {
+	// hops are the alias records in chain order.
+	hops []dns.RR
+	// targets are the names the hops redirect to, in chain order.
+	targets []string
+	// name is the last name reached, i.e. the target of the last hop.
+	name string
+	// terminal are the records of the query type owned by name.
+	terminal []dns.RR
+	// circular is set if a hop pointed back to an already visited name.
+	circular bool
+}
+
+const (
+	// hopSourceOriginal, hopSourceCache and hopSourceUpstream tell where the
+	// records of a hop came from.
+	hopSourceOriginal = "original"
+	hopSourceCache    = "cache"
+	hopSourceUpstream = "upstream"
+)
+
+// chainHop describes a hop of a resolved chain.
+type chainHop struct {
+	// name is the name redirected by the hop and target the name it
+	// redirects to.
+	name   string
+	target string
+	rrtype uint16
+	ttl    uint32
+	// source is where the hop came from.
+	source string
+}
+
+// hopsOf returns the hops of link, which starts at name, taken from source.
+func hopsOf(link chainLink, name, source string) []chainHop {
+	hops := make([]chainHop, 0, len(link.hops))
+	for i, rr := range link.hops {
+		hops = append(hops, chainHop{name: name, target: link.targets[i], rrtype: rr.Header().Rrtype, ttl: rr.Header().Ttl, source: source})
+		name = link.targets[i]
+	}
+	return hops
+}
+
+// linkChain follows the alias records in rrs starting at name, regardless of
+// their order in rrs, and collects the terminal records owned by the last
+// target. Records not linked to name are ignored. The names reached are added
+// to visited; a target already visited marks the chain as circular. If
+// maxHops is greater than zero, at most maxHops aliases are followed.
+func linkChain(rrs []dns.RR, name string, qtype uint16, visited map[string]struct{}, maxHops int) chainLink {
+	link := chainLink{name: name}
+	for maxHops <= 0 || len(link.hops) < maxHops {
+		hop, target := nextHop(rrs, link.name)
+		if hop == nil {
+			break
+		}
+		link.hops = append(link.hops, hop)
+		link.targets = append(link.targets, target)
+		link.name = target
+		if _, ok := visited[strings.ToLower(target)]; ok {
+			link.circular = true
+			return link
+		}
+		visited[strings.ToLower(target)] = struct{}{}
+	}
+
+	for _, rr := range rrs {
+		if strings.EqualFold(rr.Header().Name, link.name) && isTerminal(rr, qtype) {
+			link.terminal = append(link.terminal, rr)
+		}
+	}
+	return link
+}
+
+// nextHop returns the alias record in rrs applying to name and the name it
+// redirects to. Aliases owned by name take precedence over a DNAME of one of
+// its ancestors, as servers add the synthesized CNAME next to the DNAME.
+func nextHop(rrs []dns.RR, name string) (dns.RR, string) {
+	var dname dns.RR
+	dnameTarget := ""
+	for _, rr := range rrs {
+		if !isAlias(rr) {
+			continue
+		}
+		if rr.Header().Rrtype == dns.TypeDNAME {
+			if dname == nil {
+				if target, ok := aliasTarget(rr, name); ok {
+					dname, dnameTarget = rr, target
+				}
+			}
+			continue
+		}
+		if strings.EqualFold(rr.Header().Name, name) {
+			if target, ok := aliasTarget(rr, name); ok {
+				return rr, target
+			}
+		}
+	}
+	return dname, dnameTarget
+}
+
+// isAlias reports whether rr redirects its owner (CNAME, HTTPS/SVCB in
+// AliasMode) or the subtree below its owner (DNAME) to another name.
+func isAlias(rr dns.RR) bool {
+	switch alias := rr.(type) {
+	case *dns.CNAME, *dns.DNAME:
+		return true
+	case *dns.SVCB:
+		return alias.Priority == 0 && alias.Target != "."
+	case *dns.HTTPS:
+		return alias.Priority == 0 && alias.Target != "."
+	}
+	return false
+}
+
+// isTerminal reports whether rr ends a chain for a query of type qtype and can
+// be returned under the original query name.
+func isTerminal(rr dns.RR, qtype uint16) bool {
+	if rr.Header().Rrtype != qtype {
+		return false
+	}
+	switch terminal := rr.(type) {
+	case *dns.SVCB:
+		return terminal.Priority > 0
+	case *dns.HTTPS:
+		return terminal.Priority > 0
+	}
+	return true
+}
+
+// aliasTarget returns the name rr redirects name to. A CNAME or an HTTPS/SVCB
+// record in AliasMode (RFC 9460) redirects its owner to its target, a DNAME
+// substitutes its owner suffix in name with its target (RFC 6672), which is
+// equivalent to a synthesized CNAME.
+func aliasTarget(rr dns.RR, name string) (string, bool) {
+	switch alias := rr.(type) {
+	case *dns.CNAME:
+		return alias.Target, true
+	case *dns.SVCB:
+		return alias.Target, isAlias(alias)
+	case *dns.HTTPS:
+		return alias.Target, isAlias(alias)
+	case *dns.DNAME:
+		owner := dns.Fqdn(alias.Hdr.Name)
+		// A DNAME owned by the root would rewrite every name, its own
+		// targets included, and is rejected.
+		if owner == "." || name == "" || !dns.IsSubDomain(owner, name) || dns.CountLabel(name) == dns.CountLabel(owner) {
+			return "", false
+		}
+		offsets := dns.Split(name)
+		prefix := name[:offsets[len(offsets)-dns.CountLabel(owner)]]
+		target := prefix
+		if alias.Target != "." {
+			target += dns.Fqdn(alias.Target)
+		}
+		if _, ok := dns.IsDomainName(target); !ok || len(target) > 255 {
+			return "", false
+		}
+		return target, true
+	}
+	return "", false
+}
@@ -0,0 +1,106 @@
+package finalize
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// defaultDebugNetworks are the networks allowed to request chain
+// explanations by default.
+var defaultDebugNetworks = []string{"127.0.0.0/8", "::1/128"}
+
+// debugPolicy decides which requests get an explanation of their chain in an
+// EDNS0 local option.
+type debugPolicy struct {
+	// code is the EDNS0 local option code requesting, and carrying, the
+	// explanation.
+	code uint16
+	// networks are the client networks allowed to request explanations.
+	networks []*net.IPNet
+}
+
+// newDebugPolicy returns the policy for option code and the networks in
+// CIDR notation or as single addresses.
+func newDebugPolicy(code uint16, networks []string) (*debugPolicy, error) {
+	if code < dns.EDNS0LOCALSTART || code > dns.EDNS0LOCALEND {
+		return nil, fmt.Errorf("debug option code %d is not in the local range %d-%d", code, dns.EDNS0LOCALSTART, dns.EDNS0LOCALEND)
+	}
+	p := &debugPolicy{code: code}
+	for _, network := range networks {
+		if !strings.Contains(network, "/") {
+			ip := net.ParseIP(network)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid debug network %s", network)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			network = fmt.Sprintf("%s/%d", network, bits)
+		}
+		_, ipnet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, fmt.Errorf("invalid debug network %s: %w", network, err)
+		}
+		p.networks = append(p.networks, ipnet)
+	}
+	return p, nil
+}
+
+// requested reports whether the request state asks for an explanation and
+// its client is allowed to.
+func (p *debugPolicy) requested(state request.Request) bool {
+	if p == nil {
+		return false
+	}
+	opt := state.Req.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	asked := false
+	for _, o := range opt.Option {
+		if local, ok := o.(*dns.EDNS0_LOCAL); ok && local.Code == p.code {
+			asked = true
+			break
+		}
+	}
+	if !asked {
+		return false
+	}
+	ip := net.ParseIP(state.IP())
+	for _, network := range p.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// explain adds the explanation of the chain resolved with the result res to
+// the response r, the answer to the request state.
+func (p *debugPolicy) explain(state request.Request, r *dns.Msg, res result) {
+	opt := r.IsEdns0()
+	if opt == nil {
+		reqOpt := state.Req.IsEdns0()
+		r.SetEdns0(reqOpt.UDPSize(), reqOpt.Do())
+		opt = r.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: p.code, Data: []byte(explanation(res))})
+}
+
+// explanation describes the outcome of res and each hop of its chain with its
+// TTL and where it came from, e.g.
+//
+//	outcome flattened; www.example.org. 300 CNAME cdn.example.net. original; cdn.example.net. 60 CNAME edge.example.net. upstream
+func explanation(res result) string {
+	parts := make([]string, 0, len(res.chain)+1)
+	parts = append(parts, "outcome "+string(res.outcome))
+	for _, hop := range res.chain {
+		parts = append(parts, fmt.Sprintf("%s %d %s %s %s", hop.name, hop.ttl, dns.Type(hop.rrtype), hop.target, hop.source))
+	}
+	return strings.Join(parts, "; ")
+}
@@ -0,0 +1,66 @@
+package finalize
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestFinalizeDebug(t *testing.T) {
+	tests := []struct {
+		name     string
+		networks []string
+		option   bool
+		want     string
+	}{
+		{name: "allowed", networks: []string{"10.0.0.0/8"}, option: true, want: "outcome flattened; foo.example. 60 CNAME bar.example. original"},
+		{name: "allowed address", networks: []string{"192.0.2.1", "10.240.0.1"}, option: true, want: "outcome flattened; foo.example. 60 CNAME bar.example. original"},
+		{name: "not allowed", networks: defaultDebugNetworks, option: true},
+		{name: "not requested", networks: []string{"10.0.0.0/8"}},
+		{name: "disabled", option: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			finalize := New()
+			finalize.Next = cnameHandler{}
+			finalize.upstream = &countingLookuper{}
+			if tc.networks != nil {
+				p, err := newDebugPolicy(65001, tc.networks)
+				if err != nil {
+					t.Fatalf("failed to create debug policy: %v", err)
+				}
+				finalize.debug = p
+			}
+
+			req := new(dns.Msg)
+			req.SetQuestion("foo.example.", dns.TypeA)
+			req.SetEdns0(dns.DefaultMsgSize, false)
+			if tc.option {
+				opt := req.IsEdns0()
+				opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: 65001})
+			}
+
+			// The client address of the response writer is 10.240.0.1.
+			w := newCaptureResponseWriter()
+			if _, err := finalize.ServeDNS(context.Background(), w, req); err != nil {
+				t.Fatalf("finalize ServeDNS failed: %v", err)
+			}
+			if w.msg == nil || !allAnswersType(w.msg.Answer, dns.TypeA) {
+				t.Fatalf("expected flattened A answer, got: %v", w.msg)
+			}
+
+			got := ""
+			if opt := w.msg.IsEdns0(); opt != nil {
+				for _, o := range opt.Option {
+					if local, ok := o.(*dns.EDNS0_LOCAL); ok && local.Code == 65001 {
+						got = string(local.Data)
+					}
+				}
+			}
+			if got != tc.want {
+				t.Fatalf("expected explanation %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
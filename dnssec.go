@@ -0,0 +1,55 @@
+package finalize
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// dnssecFlatten flattens signed chains, the AD bit is only kept if every
+	// hop was authenticated.
+	dnssecFlatten = "flatten"
+	// dnssecRefuse returns signed chains unchanged.
+	dnssecRefuse = "refuse"
+)
+
+// isSigned reports whether the answer of m is signed or was authenticated by
+// the server which sent m.
+func isSigned(m *dns.Msg) bool {
+	if m.AuthenticatedData {
+		return true
+	}
+	for _, rr := range m.Answer {
+		if rr.Header().Rrtype == dns.TypeRRSIG {
+			return true
+		}
+	}
+	return false
+}
+
+// stripOrphanSignatures removes the RRSIG records from rrs which don't cover
+// an RRset in rrs, e.g. because the records they signed were flattened.
+func stripOrphanSignatures(rrs []dns.RR) []dns.RR {
+	type rrset struct {
+		name  string
+		rtype uint16
+	}
+	sets := map[rrset]struct{}{}
+	for _, rr := range rrs {
+		if rr.Header().Rrtype != dns.TypeRRSIG {
+			sets[rrset{strings.ToLower(rr.Header().Name), rr.Header().Rrtype}] = struct{}{}
+		}
+	}
+
+	kept := rrs[:0]
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			if _, ok := sets[rrset{strings.ToLower(sig.Hdr.Name), sig.TypeCovered}]; !ok {
+				continue
+			}
+		}
+		kept = append(kept, rr)
+	}
+	return kept
+}
@@ -0,0 +1,167 @@
+package finalize
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
+)
+
+// signedHandler answers the lookups of the chain bar.example. ->
+// baz.example. with signatures if the DO bit is set, and with the AD bit set
+// if ad is true.
+type signedHandler struct {
+	ad  bool
+	got []*dns.Msg
+}
+
+func (h *signedHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	h.got = append(h.got, r.Copy())
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.AuthenticatedData = h.ad
+
+	do := false
+	if opt := r.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+	switch r.Question[0].Name {
+	case "bar.example.":
+		m.Answer = []dns.RR{mustRR("bar.example. 60 IN CNAME baz.example.")}
+		if do {
+			m.Answer = append(m.Answer, mustRR("bar.example. 60 IN RRSIG CNAME 13 2 60 20300101000000 20200101000000 12345 example. AAAA"))
+		}
+	default:
+		m.Answer = []dns.RR{mustRR("baz.example. 60 IN A 203.0.113.10")}
+		if do {
+			m.Answer = append(m.Answer, mustRR("baz.example. 60 IN RRSIG A 13 2 60 20300101000000 20200101000000 12345 example. AAAA"))
+		}
+	}
+
+	_ = w.WriteMsg(m)
+	return dns.RcodeSuccess, nil
+}
+
+func (h *signedHandler) Name() string { return "signed" }
+
+// signedCnameHandler returns a signed CNAME to bar.example. with the AD bit
+// set.
+type signedCnameHandler struct{}
+
+func (h signedCnameHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.AuthenticatedData = true
+	m.Answer = []dns.RR{
+		mustRR("foo.example. 60 IN CNAME bar.example."),
+		mustRR("foo.example. 60 IN RRSIG CNAME 13 2 60 20300101000000 20200101000000 12345 example. AAAA"),
+	}
+	m.Ns = []dns.RR{
+		mustRR("example. 60 IN NS ns.example."),
+		mustRR("example. 60 IN RRSIG NS 13 1 60 20300101000000 20200101000000 12345 example. AAAA"),
+		mustRR("bar.example. 60 IN RRSIG CNAME 13 2 60 20300101000000 20200101000000 12345 example. AAAA"),
+	}
+
+	_ = w.WriteMsg(m)
+	return dns.RcodeSuccess, nil
+}
+
+func (h signedCnameHandler) Name() string { return "signedCname" }
+
+func TestFinalizeDNSSEC(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     string
+		upstreamAD bool
+		flattened  bool
+		ad         bool
+	}{
+		{name: "all hops authenticated", policy: dnssecFlatten, upstreamAD: true, flattened: true, ad: true},
+		{name: "hop not authenticated", policy: dnssecFlatten, upstreamAD: false, flattened: true, ad: false},
+		{name: "refuse", policy: dnssecRefuse, upstreamAD: true, flattened: false, ad: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			upstream := &signedHandler{ad: tc.upstreamAD}
+			cfg := &dnsserver.Config{
+				Zone:        ".",
+				ListenHosts: []string{""},
+				Port:        "53",
+				Plugin: []plugin.Plugin{
+					func(next plugin.Handler) plugin.Handler {
+						return upstream
+					},
+				},
+			}
+			server, err := dnsserver.NewServer("dns://:53", []*dnsserver.Config{cfg})
+			if err != nil {
+				t.Fatalf("failed to create server: %v", err)
+			}
+			ctx := context.WithValue(context.Background(), dnsserver.Key{}, server)
+			ctx = context.WithValue(ctx, dnsserver.LoopKey{}, 0)
+
+			finalize := New()
+			finalize.Next = signedCnameHandler{}
+			finalize.dnssecPolicy = tc.policy
+
+			req := new(dns.Msg)
+			req.SetQuestion("foo.example.", dns.TypeA)
+			req.SetEdns0(4096, true)
+			req.CheckingDisabled = true
+
+			w := newCaptureResponseWriter()
+			if _, err := finalize.ServeDNS(ctx, w, req); err != nil {
+				t.Fatalf("finalize ServeDNS failed: %v", err)
+			}
+			if w.msg == nil {
+				t.Fatal("expected finalize to write a response")
+			}
+			if w.msg.AuthenticatedData != tc.ad {
+				t.Fatalf("expected AD %t, got %t", tc.ad, w.msg.AuthenticatedData)
+			}
+
+			if !tc.flattened {
+				if len(upstream.got) != 0 {
+					t.Fatalf("expected no upstream lookups for a signed chain, got %d", len(upstream.got))
+				}
+				if countRRType(w.msg.Answer, dns.TypeCNAME) != 1 || countRRType(w.msg.Answer, dns.TypeRRSIG) != 1 {
+					t.Fatalf("expected the original signed answer, got: %v", w.msg.Answer)
+				}
+				return
+			}
+
+			if !allAnswersType(w.msg.Answer, dns.TypeA) {
+				t.Fatalf("expected only A records without signatures, got: %v", w.msg.Answer)
+			}
+			if len(w.msg.Ns) != 2 || countRRType(w.msg.Ns, dns.TypeRRSIG) != 1 {
+				t.Fatalf("expected only the signature of the NS RRset to be kept, got: %v", w.msg.Ns)
+			}
+			for _, got := range upstream.got {
+				opt := got.IsEdns0()
+				if opt == nil || !opt.Do() || !got.CheckingDisabled {
+					t.Fatalf("expected DO and CD bits to be carried to the upstream lookup, got: %v", got)
+				}
+			}
+		})
+	}
+}
+
+func TestStripOrphanSignatures(t *testing.T) {
+	rrs := []dns.RR{
+		mustRR("foo.example. 60 IN A 203.0.113.10"),
+		mustRR("FOO.example. 60 IN RRSIG A 13 2 60 20300101000000 20200101000000 12345 example. AAAA"),
+		mustRR("baz.example. 60 IN RRSIG A 13 2 60 20300101000000 20200101000000 12345 example. AAAA"),
+		mustRR("foo.example. 60 IN RRSIG AAAA 13 2 60 20300101000000 20200101000000 12345 example. AAAA"),
+	}
+
+	kept := stripOrphanSignatures(rrs)
+	if len(kept) != 2 {
+		t.Fatalf("expected the A record and its signature, got: %v", kept)
+	}
+	if sig, ok := kept[1].(*dns.RRSIG); !ok || sig.TypeCovered != dns.TypeA || sig.Hdr.Name != "FOO.example." {
+		t.Fatalf("expected the signature covering the A record, got: %v", kept[1])
+	}
+}
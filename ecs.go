@@ -0,0 +1,149 @@
+package finalize
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+const (
+	// ecsStrip removes the client subnet from lookups.
+	ecsStrip = "strip"
+	// ecsForward sends the client subnet of the request, truncated to the
+	// configured prefix lengths.
+	ecsForward = "forward"
+	// ecsSynthesize is like ecsForward, but synthesizes the subnet from the
+	// client address if the request has none.
+	ecsSynthesize = "synthesize"
+
+	defaultECSPrefixV4 = 24
+	defaultECSPrefixV6 = 56
+)
+
+// ecsPolicy sets the EDNS0 client subnet option of the lookups for a chain.
+type ecsPolicy struct {
+	mode     string
+	prefixV4 uint8
+	prefixV6 uint8
+}
+
+// apply returns the request used for the lookups of a chain requested by
+// state, and the client subnet it carries, if any. Without a policy the
+// client subnet of the request is kept as is.
+func (p *ecsPolicy) apply(state request.Request) (request.Request, *dns.EDNS0_SUBNET) {
+	client := clientSubnet(state.Req)
+	if p == nil {
+		return state, client
+	}
+
+	var subnet *dns.EDNS0_SUBNET
+	switch p.mode {
+	case ecsForward:
+		if client != nil {
+			subnet = p.truncate(client.Family, client.Address, client.SourceNetmask)
+		}
+	case ecsSynthesize:
+		if client != nil {
+			subnet = p.truncate(client.Family, client.Address, client.SourceNetmask)
+		} else if ip := net.ParseIP(state.IP()); ip != nil {
+			family := uint16(2)
+			if ip.To4() != nil {
+				family = 1
+			}
+			subnet = p.truncate(family, ip, 128)
+		}
+	}
+	if subnet == nil && client == nil {
+		return state, nil
+	}
+
+	req := state.Req.Copy()
+	opt := req.IsEdns0()
+	if opt == nil {
+		req.SetEdns0(dns.DefaultMsgSize, false)
+		opt = req.IsEdns0()
+	}
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0SUBNET {
+			options = append(options, o)
+		}
+	}
+	if subnet != nil {
+		options = append(options, subnet)
+	}
+	opt.Option = options
+
+	return request.Request{W: state.W, Req: req}, subnet
+}
+
+// truncate returns the subnet of address with the prefix length limited to
+// the configured one of its family.
+func (p *ecsPolicy) truncate(family uint16, address net.IP, prefix uint8) *dns.EDNS0_SUBNET {
+	limit, bits := p.prefixV4, 32
+	if family == 2 {
+		limit, bits = p.prefixV6, 128
+	} else {
+		address = address.To4()
+	}
+	if prefix > limit {
+		prefix = limit
+	}
+	if address == nil || int(prefix) > bits {
+		return nil
+	}
+	return &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        family,
+		SourceNetmask: prefix,
+		Address:       address.Mask(net.CIDRMask(int(prefix), bits)),
+	}
+}
+
+// clientSubnet returns the EDNS0 client subnet option of m, if any.
+func clientSubnet(m *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return subnet
+		}
+	}
+	return nil
+}
+
+// subnetKeys returns the keys of the cache entries valid for subnet, from the
+// longest scope, its source prefix length, down to the entries valid for all
+// clients.
+func subnetKeys(subnet *dns.EDNS0_SUBNET) []string {
+	if subnet == nil {
+		return []string{""}
+	}
+	keys := make([]string, 0, int(subnet.SourceNetmask)+1)
+	for scope := subnet.SourceNetmask; scope > 0; scope-- {
+		keys = append(keys, subnetKey(subnet, scope))
+	}
+	return append(keys, "")
+}
+
+// subnetKey returns the key of the cache entries resolved for subnet, limited
+// to the scope prefix length of the answer. Answers without a subnet, or with
+// a scope of 0, are valid for all clients and have the empty key. A scope
+// beyond the source prefix length selects the whole source prefix.
+func subnetKey(subnet *dns.EDNS0_SUBNET, scope uint8) string {
+	if subnet == nil || scope == 0 {
+		return ""
+	}
+	bits := 32
+	if subnet.Family == 2 {
+		bits = 128
+	}
+	if scope > subnet.SourceNetmask {
+		scope = subnet.SourceNetmask
+	}
+	return fmt.Sprintf("%s/%d", subnet.Address.Mask(net.CIDRMask(int(scope), bits)), scope)
+}
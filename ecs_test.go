@@ -0,0 +1,161 @@
+package finalize
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/plugin"
+	plugintest "github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+func newSubnetRequest(cidr string) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion("foo.example.", dns.TypeA)
+	if cidr == "" {
+		return req
+	}
+	req.SetEdns0(4096, false)
+	ip, ipnet, _ := net.ParseCIDR(cidr)
+	ones, _ := ipnet.Mask.Size()
+	subnet := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: uint8(ones), Address: ip}
+	if ip.To4() == nil {
+		subnet.Family = 2
+	}
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, subnet)
+	return req
+}
+
+func TestECSPolicyApply(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   *ecsPolicy
+		client   string
+		expected string
+	}{
+		{name: "no policy", client: "192.0.2.77/32", expected: "192.0.2.77/32"},
+		{name: "strip", policy: &ecsPolicy{mode: ecsStrip}, client: "192.0.2.77/32"},
+		{name: "forward truncates", policy: &ecsPolicy{mode: ecsForward, prefixV4: 24, prefixV6: 56}, client: "192.0.2.77/32", expected: "192.0.2.0/24"},
+		{name: "forward keeps shorter prefix", policy: &ecsPolicy{mode: ecsForward, prefixV4: 24, prefixV6: 56}, client: "192.0.0.0/16", expected: "192.0.0.0/16"},
+		{name: "forward IPv6", policy: &ecsPolicy{mode: ecsForward, prefixV4: 24, prefixV6: 56}, client: "2001:db8:1:2ff::1/128", expected: "2001:db8:1:200::/56"},
+		{name: "forward without subnet", policy: &ecsPolicy{mode: ecsForward, prefixV4: 24, prefixV6: 56}},
+		{name: "synthesize", policy: &ecsPolicy{mode: ecsSynthesize, prefixV4: 20, prefixV6: 56}, expected: "10.240.0.0/20"},
+		{name: "synthesize prefers subnet", policy: &ecsPolicy{mode: ecsSynthesize, prefixV4: 24, prefixV6: 56}, client: "192.0.2.77/32", expected: "192.0.2.0/24"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			state := request.Request{W: &plugintest.ResponseWriter{}, Req: newSubnetRequest(tc.client)}
+			before := state.Req.String()
+			lookup, subnet := tc.policy.apply(state)
+			if state.Req.String() != before {
+				t.Fatal("expected the client request to be left unchanged")
+			}
+
+			sent := clientSubnet(lookup.Req)
+			if tc.expected == "" {
+				if sent != nil || subnet != nil {
+					t.Fatalf("expected no client subnet, got %v", sent)
+				}
+				return
+			}
+			if sent == nil || subnet == nil {
+				t.Fatalf("expected client subnet %s, got none", tc.expected)
+			}
+			got := (&net.IPNet{IP: sent.Address, Mask: net.CIDRMask(int(sent.SourceNetmask), 8*len(sent.Address))}).String()
+			if sent.Family == 1 {
+				got = (&net.IPNet{IP: sent.Address.To4(), Mask: net.CIDRMask(int(sent.SourceNetmask), 32)}).String()
+			}
+			if got != tc.expected {
+				t.Fatalf("expected client subnet %s, got %s", tc.expected, got)
+			}
+		})
+	}
+}
+
+// subnetHandler answers bar.example. with an A record and echoes the client
+// subnet of the request with the given scope.
+type subnetHandler struct {
+	scope uint8
+	got   []*dns.Msg
+}
+
+func (h *subnetHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	h.got = append(h.got, r.Copy())
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Answer = []dns.RR{mustRR(r.Question[0].Name + " 60 IN A 203.0.113.10")}
+	if subnet := clientSubnet(r); subnet != nil {
+		echo := *subnet
+		echo.SourceScope = h.scope
+		m.SetEdns0(4096, false)
+		m.IsEdns0().Option = append(m.IsEdns0().Option, &echo)
+	}
+
+	_ = w.WriteMsg(m)
+	return dns.RcodeSuccess, nil
+}
+
+func (h *subnetHandler) Name() string { return "subnet" }
+
+func TestFinalizeCachesPerSubnet(t *testing.T) {
+	tests := []struct {
+		name    string
+		scope   uint8
+		clients []string
+		lookups int
+	}{
+		// The first two clients share their /24, the third doesn't.
+		{name: "scoped answers", scope: 24, clients: []string{"192.0.2.10/32", "192.0.2.20/32", "198.51.100.10/32"}, lookups: 2},
+		{name: "global answers", scope: 0, clients: []string{"192.0.2.10/32", "192.0.2.20/32", "198.51.100.10/32"}, lookups: 1},
+		// A scope shorter than the source prefix covers other /24s too.
+		{name: "scope shorter than source", scope: 16, clients: []string{"192.0.2.10/32", "192.0.2.20/32", "192.0.5.20/32", "198.51.100.10/32"}, lookups: 2},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			upstream := &subnetHandler{scope: tc.scope}
+			cfg := &dnsserver.Config{
+				Zone:        ".",
+				ListenHosts: []string{""},
+				Port:        "53",
+				Plugin: []plugin.Plugin{
+					func(next plugin.Handler) plugin.Handler {
+						return upstream
+					},
+				},
+			}
+			server, err := dnsserver.NewServer("dns://:53", []*dnsserver.Config{cfg})
+			if err != nil {
+				t.Fatalf("failed to create server: %v", err)
+			}
+			ctx := context.WithValue(context.Background(), dnsserver.Key{}, server)
+			ctx = context.WithValue(ctx, dnsserver.LoopKey{}, 0)
+
+			finalize := New()
+			finalize.Next = cnameHandler{}
+			finalize.cache = newChainCache(100, defaultCacheMaxTTL)
+			finalize.ecs = &ecsPolicy{mode: ecsForward, prefixV4: 24, prefixV6: 56}
+
+			for _, client := range tc.clients {
+				w := newCaptureResponseWriter()
+				if _, err := finalize.ServeDNS(ctx, w, newSubnetRequest(client)); err != nil {
+					t.Fatalf("finalize ServeDNS failed: %v", err)
+				}
+				if w.msg == nil || !allAnswersType(w.msg.Answer, dns.TypeA) {
+					t.Fatalf("expected a flattened answer, got: %v", w.msg)
+				}
+			}
+			if len(upstream.got) != tc.lookups {
+				t.Fatalf("expected %d upstream lookups, got %d", tc.lookups, len(upstream.got))
+			}
+			subnet := clientSubnet(upstream.got[0])
+			if subnet == nil || subnet.SourceNetmask != 24 || !subnet.Address.Equal(net.ParseIP("192.0.2.0")) {
+				t.Fatalf("expected the truncated client subnet in the lookup, got %v", subnet)
+			}
+		})
+	}
+}
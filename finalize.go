@@ -2,13 +2,16 @@ package finalize
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/plugin/metrics"
 	clog "github.com/coredns/coredns/plugin/pkg/log"
 	"github.com/coredns/coredns/plugin/pkg/nonwriter"
+	"github.com/coredns/coredns/plugin/pkg/singleflight"
 	"github.com/coredns/coredns/plugin/pkg/upstream"
 	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
@@ -20,20 +23,80 @@ var log = clog.NewWithPlugin("finalize")
 type Finalize struct {
 	Next plugin.Handler
 
-	upstream     *upstream.Upstream
+	upstream     lookuper
 	maxDepth     int
 	forceResolve bool
+	cache        *chainCache
+	inflight     *singleflight.Group
+	// types holds the query types whose answers are flattened.
+	types map[uint16]struct{}
+	// zones are the zones whose query names or CNAME targets are flattened,
+	// except holds names excluded from them.
+	zones  []string
+	except []string
+	// onFailure maps failure outcomes to the rcode of the response sent
+	// instead of the original answer.
+	onFailure map[outcome]int
+	// ttl selects the TTL of flattened answers.
+	ttl ttlPolicy
+	// dnssecPolicy decides whether signed chains are flattened.
+	dnssecPolicy string
+	// anchors are the trust anchors chains are validated against, keyed by
+	// owner. Chains aren't validated without anchors.
+	anchors map[string][]dns.RR
+	// ecs sets the client subnet of lookups; without a policy the client
+	// subnet of the request is used.
+	ecs *ecsPolicy
+	// sections decides what happens to the authority and additional
+	// sections of flattened answers.
+	sections string
+	// timeout limits a single lookup, deadline the resolution of a whole
+	// chain. Zero means no limit.
+	timeout  time.Duration
+	deadline time.Duration
+	// retries is the number of retries of a failed lookup, starting after
+	// retryBackoff. tcpFallback retries truncated or failed lookups over TCP.
+	retries      int
+	retryBackoff time.Duration
+	tcpFallback  bool
+	// staleTTL is the TTL of answers served stale from the cache after a
+	// failed lookup. Zero disables serving stale answers.
+	staleTTL uint32
+	// debug decides which clients get an explanation of the chain; nil
+	// disables explanations.
+	debug *debugPolicy
 }
 
+// defaultRetryBackoff is the time to wait before the first retry of a failed
+// lookup.
+const defaultRetryBackoff = 100 * time.Millisecond
+
+// defaultTypes are the query types flattened when no types are configured.
+var defaultTypes = []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeSVCB, dns.TypeHTTPS}
+
 func New() *Finalize {
 	s := &Finalize{
-		upstream: upstream.New(),
-		maxDepth: 0,
+		upstream:     upstream.New(),
+		maxDepth:     0,
+		types:        make(map[uint16]struct{}, len(defaultTypes)),
+		inflight:     new(singleflight.Group),
+		zones:        []string{"."},
+		onFailure:    map[outcome]int{},
+		ttl:          defaultTTLPolicy,
+		dnssecPolicy: dnssecFlatten,
+		sections:     sectionsKeep,
+		retryBackoff: defaultRetryBackoff,
+	}
+	for _, t := range defaultTypes {
+		s.types[t] = struct{}{}
 	}
 
 	return s
 }
 
+// FinalizeLoopKey marks the context of lookups made by finalize. When such a
+// lookup is routed through the plugin chain, finalize passes it on to the
+// next plugin, so the chain is linked from the raw answers.
 type FinalizeLoopKey struct{}
 
 func minTTL(rrs []dns.RR, currentMin uint32) uint32 {
@@ -57,6 +120,10 @@ func (s *Finalize) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Ms
 	}
 	log.Debugf("ServeDNS query name=%s type=%s force_resolve=%t max_depth=%d", qname, dns.Type(qtype).String(), s.forceResolve, s.maxDepth)
 
+	if ctx.Value(FinalizeLoopKey{}) != nil {
+		return plugin.NextOrFailure(s.Name(), s.Next, ctx, w, r)
+	}
+
 	req := r.Copy()
 	origName := ""
 	if len(req.Question) > 0 {
@@ -75,106 +142,80 @@ func (s *Finalize) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Ms
 	}
 	log.Debugf("Upstream response rcode=%s answers=%d", dns.RcodeToString[r.Rcode], len(r.Answer))
 
-	if len(r.Question) > 0 && r.Question[0].Qtype == dns.TypeCNAME {
-		log.Debug("Request is a CNAME type question, skipping")
+	if len(r.Question) > 0 && (r.Question[0].Qtype == dns.TypeCNAME || r.Question[0].Qtype == dns.TypeDNAME) {
+		log.Debug("Request is a CNAME or DNAME type question, skipping")
+		if err := w.WriteMsg(r); err != nil {
+			return 1, err
+		}
+		return 0, nil
+	}
+
+	if _, ok := s.types[qtype]; !ok {
+		log.Debugf("Request type %s isn't configured for flattening, skipping", dns.Type(qtype).String())
 		if err := w.WriteMsg(r); err != nil {
 			return 1, err
 		}
 		return 0, nil
 	}
 
-	if len(r.Answer) > 0 && r.Answer[0].Header().Rrtype == dns.TypeCNAME {
+	// emulate hashset in go; https://emersion.fr/blog/2017/sets-in-go/
+	visited := map[string]struct{}{strings.ToLower(origName): {}}
+	maxHops := 0
+	if s.forceResolve {
+		// Only the first hop of the original answer is used, all following
+		// targets are resolved via upstream.
+		maxHops = 1
+	}
+	link := linkChain(r.Answer, origName, qtype, visited, maxHops)
+
+	zone := ""
+	if len(link.hops) > 0 {
+		zone = s.match(origName, link.targets)
+	}
+
+	if len(link.hops) > 0 && zone == "" {
+		log.Debugf("Query name %s and its CNAME targets are not in the configured zones, skipping", origName)
+	} else if len(link.hops) > 0 {
 		log.Debugf("Finalizing CNAME for request: %+v", r)
 
 		requestCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
 		defer recordDuration(ctx, time.Now())
 
-		state := request.Request{W: w, Req: req}
-		// emulate hashset in go; https://emersion.fr/blog/2017/sets-in-go/
-		cnameVisited := make(map[string]struct{})
-		cnt := 0
-		rr := r.Answer[0]
-		answers := []dns.RR{}
-		success := true
-		minTTLSeen := minTTL(r.Answer, 0)
-
-	resolveCname:
-		target := rr.(*dns.CNAME).Target
-		cnameTTL := rr.Header().Ttl
-		if cnameTTL < minTTLSeen {
-			minTTLSeen = cnameTTL
-		}
-		if origName == "" {
-			origName = target
-		}
-		log.Debugf("Trying to resolve CNAME target=%s type=%s", target, dns.Type(state.QType()).String())
-
-		if s.maxDepth > 0 && cnt >= s.maxDepth {
-			maxDepthReachedCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
-
-			log.Errorf("Max depth %d reached for resolving CNAME records", s.maxDepth)
-		} else if _, ok := cnameVisited[target]; ok {
-			circularReferenceCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
-
-			log.Errorf("Detected circular reference in CNAME chain. CNAME [%s] already processed", target)
-		} else {
-			terminal := terminalAnswers(r.Answer)
-			if len(terminal) > 0 && !s.forceResolve {
-				log.Debugf("Using terminal A/AAAA from original answer count=%d", len(terminal))
-				minTTLSeen = minTTL(r.Answer, minTTLSeen)
-				answers = append(answers, flattenAnswers(terminal, origName, minTTLSeen)...)
-			} else {
-				if len(terminal) > 0 && s.forceResolve {
-					log.Debugf("force_resolve enabled; ignoring terminal A/AAAA in original answer count=%d", len(terminal))
-				}
-				up, err := s.upstream.Lookup(ctx, state, target, state.QType())
-				if err != nil {
-					upstreamErrorCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
-					success = false
-
-					log.Errorf("Failed to lookup CNAME [%+v] from upstream: [%+v]", rr, err)
-				} else {
-					ansCount := 0
-					if up.Answer != nil {
-						ansCount = len(up.Answer)
-					}
-					log.Debugf("Lookup response rcode=%s answers=%d", dns.RcodeToString[up.Rcode], ansCount)
-
-					if len(up.Answer) == 0 {
-						danglingCNameCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
-						success = false
-
-						log.Errorf("Received no answer from upstream: [%+v]", up)
-					} else {
-						rr = up.Answer[0]
-						minTTLSeen = minTTL(up.Answer, minTTLSeen)
-						switch rr.Header().Rrtype {
-						case dns.TypeCNAME:
-							cnt++
-							cnameVisited[target] = struct{}{}
-
-							goto resolveCname
-						case dns.TypeA:
-							fallthrough
-						case dns.TypeAAAA:
-							answers = append(answers, flattenAnswers(up.Answer, origName, minTTLSeen)...)
-						default:
-							log.Errorf("Upstream server returned unsupported type [%+v] for CNAME question [%+v]", rr, up.Question[0])
-							success = false
-						}
-					}
-				}
-			}
+		resolveCtx := ctx
+		if s.deadline > 0 {
+			var cancel context.CancelFunc
+			resolveCtx, cancel = context.WithTimeout(ctx, s.deadline)
+			defer cancel()
 		}
 
-		if success && len(answers) > 0 {
-			log.Debugf("Finalized answer count=%d name=%s", len(answers), origName)
-			r.Answer = answers
-		} else if !success {
-			log.Debugf("Finalization failed; returning original answer")
+		state := request.Request{W: w, Req: req}
+		resolveCtx, span := startChainSpan(resolveCtx, origName, qtype)
+		res := s.resolve(resolveCtx, state, r, link, visited)
+		finishChainSpan(span, res)
+		record(ctx, res)
+		resolutionCount.WithLabelValues(metrics.WithServer(ctx), dns.Type(qtype).String(), string(res.outcome), zone).Inc()
+		chainDepth.WithLabelValues(metrics.WithServer(ctx), string(res.outcome)).Observe(float64(len(res.chain)))
+		lookupsPerQuery.WithLabelValues(metrics.WithServer(ctx), string(res.outcome)).Observe(float64(res.lookups))
+		if !res.outcome.failed() && len(res.answers) > 0 {
+			log.Debugf("Finalized answer count=%d name=%s", len(res.answers), origName)
+			r.Answer = res.answers
+			// The next plugin may have answered negatively for the last
+			// target it knew; the flattened answer is positive.
+			r.Rcode = dns.RcodeSuccess
+			r.AuthenticatedData = res.authenticated
+			s.rewriteSections(state, r, res)
+			if res.outcome == outcomeStale {
+				markStale(r)
+			}
+		} else if res.outcome.failed() {
+			log.Debugf("Finalization failed with outcome %s", res.outcome)
+			s.applyFailurePolicy(r, res)
 		} else {
 			log.Debugf("Finalization produced no answers; returning original answer")
 		}
+		if s.debug.requested(state) {
+			s.debug.explain(state, r, res)
+		}
 	} else {
 		log.Debug("Request didn't contain any answer or no CNAME")
 	}
@@ -187,32 +228,339 @@ func (s *Finalize) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Ms
 	return 0, nil
 }
 
+// match returns the configured zone which makes a query for qname, whose
+// answer redirects to targets, eligible for flattening. The query name is
+// matched first, then the targets in chain order. Excluded names never match
+// and an excluded query name isn't flattened at all. The empty string means
+// the query is out of scope.
+func (s *Finalize) match(qname string, targets []string) string {
+	except := plugin.Zones(s.except)
+	if except.Matches(qname) != "" {
+		return ""
+	}
+	zones := plugin.Zones(s.zones)
+	if zone := zones.Matches(qname); zone != "" {
+		return zone
+	}
+	for _, target := range targets {
+		if except.Matches(target) != "" {
+			continue
+		}
+		if zone := zones.Matches(target); zone != "" {
+			return zone
+		}
+	}
+	return ""
+}
+
+// result is the result of resolving a chain.
+type result struct {
+	outcome outcome
+	// answers are the terminal records renamed to the query name.
+	answers []dns.RR
+	// negative is the negative response to the lookup of the last target of
+	// a dangling chain, ttls the TTLs of the chain leading to it.
+	negative *dns.Msg
+	ttls     chainTTLs
+	// terminal is the response the terminal records were taken from, nil
+	// for chains served from the cache.
+	terminal *dns.Msg
+	// authenticated is set if the chain was validated, or without trust
+	// anchors, if the original answer and all lookups had the AD bit set.
+	authenticated bool
+	// chain are the aliases followed and lookups the number of names of the
+	// chain looked up via upstream.
+	chain   []chainHop
+	lookups int
+}
+
+// resolve continues the chain link taken from the original answer orig until
+// the terminal records for the query type are found and returns those records
+// renamed to the query name.
+func (s *Finalize) resolve(ctx context.Context, state request.Request, orig *dns.Msg, link chainLink, visited map[string]struct{}) (res result) {
+	origName := state.QName()
+	qtype := state.QType()
+	lookups := 0
+	headSource := hopSourceOriginal
+	defer func() {
+		res.chain = append(hopsOf(link, origName, headSource), res.chain...)
+		res.lookups += lookups
+	}()
+
+	if s.dnssecPolicy == dnssecRefuse && isSigned(orig) {
+		log.Debugf("Original answer for %s is signed; not flattening", origName)
+		return result{outcome: outcomeSigned}
+	}
+
+	// With trust anchors every part of the chain is validated. Lookups are
+	// made with the DO bit set, so they return the signatures.
+	lookupState, subnet := s.ecs.apply(state)
+	var v *validation
+	if s.anchors != nil {
+		v = s.newValidation(lookupState)
+		lookupState = v.state
+		if _, sigs := rrsetOf(orig.Answer, link.hops[0].Header().Name, link.hops[0].Header().Rrtype); len(sigs) == 0 {
+			log.Debugf("Original answer for %s has no signatures; looking up the signed answer", origName)
+			hopCtx, span := startHopSpan(ctx, origName, qtype, hopSourceUpstream)
+			up, err := s.lookup(hopCtx, lookupState, origName, qtype)
+			finishHopSpan(span, up, err)
+			lookups++
+			if err != nil {
+				return s.lookupFailure(ctx, origName, err)
+			}
+			maxHops := 0
+			if s.forceResolve {
+				maxHops = 1
+			}
+			visited = map[string]struct{}{strings.ToLower(origName): {}}
+			link = linkChain(up.Answer, origName, qtype, visited, maxHops)
+			orig = up
+			headSource = hopSourceUpstream
+		}
+	}
+	authenticated := orig.AuthenticatedData || v != nil
+	traceOriginalHops(ctx, orig, link, qtype, headSource)
+
+	if link.circular {
+		circularReferenceCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+
+		log.Errorf("Detected circular reference in CNAME chain. CNAME [%s] already processed", link.name)
+		return result{outcome: outcomeCircular}
+	}
+
+	if v != nil {
+		if err := v.validateLink(ctx, orig, link); err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				return s.lookupFailure(ctx, origName, err)
+			}
+			validationFailureCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+
+			log.Errorf("Failed to validate answer for [%s]: %v", origName, err)
+			return result{outcome: outcomeBogus}
+		}
+	}
+
+	var ttls chainTTLs
+	ttls.addHops(link.hops)
+
+	if len(link.terminal) > 0 {
+		if !s.forceResolve {
+			log.Debugf("Using terminal %s from original answer count=%d", dns.Type(qtype).String(), len(link.terminal))
+			ttls.addTerminal(link.terminal)
+			return result{outcome: outcomeTerminalReused, answers: flattenAnswers(link.terminal, origName, s.ttl.apply(ttls)), terminal: orig, authenticated: authenticated}
+		}
+		log.Debugf("force_resolve enabled; ignoring terminal %s in original answer count=%d", dns.Type(qtype).String(), len(link.terminal))
+	}
+
+	w := &chainWalk{state: state, lookupState: lookupState, v: v, subnet: subnet, visited: visited}
+	return s.resolveTail(ctx, w, link.name, ttls, authenticated)
+}
+
+// chainWalk is what resolving the targets of a chain via upstream needs
+// besides the chain itself.
+type chainWalk struct {
+	// state is the client request, lookupState the request the lookups are
+	// made for.
+	state       request.Request
+	lookupState request.Request
+	// v validates the lookups, if trust anchors are configured.
+	v       *validation
+	subnet  *dns.EDNS0_SUBNET
+	visited map[string]struct{}
+	// refresh skips reading the cache, so the chain is resolved and cached
+	// anew.
+	refresh bool
+}
+
+// resolveTail resolves the chain from name, its first target not resolved by
+// the original answer, until the terminal records for the query type are
+// found. ttls and authenticated describe the chain up to name.
+func (s *Finalize) resolveTail(ctx context.Context, w *chainWalk, name string, ttls chainTTLs, authenticated bool) (res result) {
+	origName := w.state.QName()
+	qtype := w.state.QType()
+	var chain []chainHop
+	lookups := 0
+	defer func() {
+		res.chain = chain
+		res.lookups += lookups
+	}()
+
+	// cacheTarget is the first target resolved via upstream and tail the
+	// chain from there on, which makes up the cache entry. Lookups with the
+	// CD bit set aren't validated upstream and bypass the cache.
+	useCache := s.cache != nil && !w.state.Req.CheckingDisabled
+	// Stale answers are only as authenticated as the chain up to the cache
+	// entry.
+	headAuthenticated := authenticated
+	cacheTarget := ""
+	tail := cacheItem{qtype: qtype, authenticated: true}
+	// scope is the longest scope prefix length of the client subnet in the
+	// answers of the tail.
+	scope := uint8(0)
+	for {
+		log.Debugf("Trying to resolve CNAME target=%s type=%s", name, dns.Type(qtype).String())
+
+		if s.maxDepth > 0 && lookups >= s.maxDepth {
+			maxDepthReachedCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+
+			log.Errorf("Max depth %d reached for resolving CNAME records", s.maxDepth)
+			return result{outcome: outcomeMaxDepth}
+		}
+
+		if useCache && !w.refresh {
+			if item, ok := s.cache.get(ctx, name, qtype, w.subnet); ok {
+				log.Debugf("Using cached answer for CNAME target=%s count=%d ttl=%d", name, len(item.answers), item.ttl)
+				if s.dnssecPolicy == dnssecRefuse && item.signed {
+					log.Debugf("Cached chain for %s is signed; not flattening", name)
+					return result{outcome: outcomeSigned}
+				}
+				if s.cache.prefetchDue(item) {
+					go s.prefetch(ctx, w, name, item.usage)
+				}
+				traceCachedHop(ctx, name, qtype, item)
+				for _, hop := range item.chain {
+					hop.source = hopSourceCache
+					chain = append(chain, hop)
+				}
+				ttls.merge(item.ttls)
+				authenticated = authenticated && item.authenticated
+				return result{outcome: outcomeFlattened, answers: flattenAnswers(item.answers, origName, s.ttl.apply(ttls)), authenticated: authenticated}
+			}
+		}
+		if cacheTarget == "" {
+			cacheTarget = name
+		}
+
+		hopCtx, span := startHopSpan(ctx, name, qtype, hopSourceUpstream)
+		up, err := s.lookup(hopCtx, w.lookupState, name, qtype)
+		finishHopSpan(span, up, err)
+		lookups++
+		if err != nil {
+			return s.serveStale(ctx, w.state, s.lookupFailure(ctx, name, err), cacheTarget, w.subnet, headAuthenticated)
+		}
+		log.Debugf("Lookup response rcode=%s answers=%d", dns.RcodeToString[up.Rcode], len(up.Answer))
+
+		if isSigned(up) {
+			if s.dnssecPolicy == dnssecRefuse {
+				log.Debugf("Answer for CNAME target %s is signed; not flattening", name)
+				return result{outcome: outcomeSigned}
+			}
+			tail.signed = true
+		}
+		if answered := clientSubnet(up); answered != nil && answered.SourceScope > scope {
+			scope = answered.SourceScope
+		}
+		if w.v == nil {
+			authenticated = authenticated && up.AuthenticatedData
+			tail.authenticated = tail.authenticated && up.AuthenticatedData
+		}
+
+		// Only NOERROR and NXDOMAIN answers tell anything about the target,
+		// other rcodes are failures of the upstream.
+		if up.Rcode != dns.RcodeSuccess && up.Rcode != dns.RcodeNameError {
+			err := fmt.Errorf("upstream returned %s", dns.RcodeToString[up.Rcode])
+			return s.serveStale(ctx, w.state, s.lookupFailure(ctx, name, err), cacheTarget, w.subnet, headAuthenticated)
+		}
+		if len(up.Answer) == 0 {
+			danglingCNameCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+
+			log.Errorf("Received no answer from upstream: [%+v]", up)
+			return result{outcome: outcomeDangling, negative: up, ttls: ttls}
+		}
+
+		next := linkChain(up.Answer, name, qtype, w.visited, 0)
+		if next.circular {
+			circularReferenceCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+
+			log.Errorf("Detected circular reference in CNAME chain. CNAME [%s] already processed", next.name)
+			return result{outcome: outcomeCircular}
+		}
+		if len(next.hops) == 0 && len(next.terminal) == 0 {
+			danglingCNameCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+
+			log.Errorf("Upstream server returned no %s or alias records for CNAME target [%s]: [%+v]", dns.Type(qtype).String(), name, up.Answer)
+			return result{outcome: outcomeDangling}
+		}
+		if w.v != nil {
+			if err := w.v.validateLink(ctx, up, next); err != nil {
+				if errors.Is(err, context.DeadlineExceeded) {
+					return s.serveStale(ctx, w.state, s.lookupFailure(ctx, name, err), cacheTarget, w.subnet, headAuthenticated)
+				}
+				validationFailureCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+
+				log.Errorf("Failed to validate answer for CNAME target [%s]: %v", name, err)
+				return result{outcome: outcomeBogus}
+			}
+		}
+
+		chain = append(chain, hopsOf(next, name, hopSourceUpstream)...)
+		ttls.addHops(next.hops)
+		tail.ttls.addHops(next.hops)
+		if len(next.terminal) > 0 {
+			ttls.addTerminal(next.terminal)
+			tail.ttls.addTerminal(next.terminal)
+			if useCache {
+				tail.name = cacheTarget
+				tail.subnet = subnetKey(w.subnet, scope)
+				tail.answers = next.terminal
+				tail.chain = chain
+				s.cache.set(ctx, &tail)
+			}
+			return result{outcome: outcomeFlattened, answers: flattenAnswers(next.terminal, origName, s.ttl.apply(ttls)), terminal: up, authenticated: authenticated}
+		}
+		name = next.name
+	}
+}
+
+// lookupFailure returns the result of a failed lookup of name. Lookups
+// running out of time are counted apart from other upstream errors.
+func (s *Finalize) lookupFailure(ctx context.Context, name string, err error) result {
+	if errors.Is(err, context.DeadlineExceeded) {
+		timeoutCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+
+		log.Errorf("Timeout while looking up CNAME target [%s] from upstream", name)
+		return result{outcome: outcomeTimeout}
+	}
+	upstreamErrorCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+
+	log.Errorf("Failed to lookup CNAME target [%s] from upstream: [%+v]", name, err)
+	return result{outcome: outcomeUpstreamError}
+}
+
 // Name implements the Handler interface.
 func (al *Finalize) Name() string { return "finalize" }
 
-func terminalAnswers(rrs []dns.RR) []dns.RR {
+func terminalAnswers(rrs []dns.RR, qtype uint16) []dns.RR {
 	terminal := make([]dns.RR, 0, len(rrs))
 	for _, rr := range rrs {
-		switch rr.Header().Rrtype {
-		case dns.TypeA, dns.TypeAAAA:
+		if isTerminal(rr, qtype) {
 			terminal = append(terminal, rr)
 		}
 	}
 	return terminal
 }
 
+// flattenAnswers renames the terminal records rrs to name and sets their TTL
+// to ttl.
 func flattenAnswers(rrs []dns.RR, name string, ttl uint32) []dns.RR {
 	flattened := make([]dns.RR, 0, len(rrs))
 	for _, rr := range rrs {
-		switch rr.Header().Rrtype {
-		case dns.TypeA, dns.TypeAAAA:
-			copied := dns.Copy(rr)
-			copied.Header().Name = name
-			if ttl > 0 {
-				copied.Header().Ttl = ttl
+		copied := dns.Copy(rr)
+		// A ServiceMode TargetName of "." refers to the owner name, which
+		// changes when flattening; pin it to the original owner.
+		switch svc := copied.(type) {
+		case *dns.SVCB:
+			if svc.Target == "." {
+				svc.Target = rr.Header().Name
+			}
+		case *dns.HTTPS:
+			if svc.Target == "." {
+				svc.Target = rr.Header().Name
 			}
-			flattened = append(flattened, copied)
 		}
+		copied.Header().Name = name
+		copied.Header().Ttl = ttl
+		flattened = append(flattened, copied)
 	}
 	return flattened
 }
@@ -221,3 +569,8 @@ func recordDuration(ctx context.Context, start time.Time) {
 	requestDuration.WithLabelValues(metrics.WithServer(ctx)).
 		Observe(time.Since(start).Seconds())
 }
+
+func recordLookupDuration(ctx context.Context, start time.Time) {
+	lookupDuration.WithLabelValues(metrics.WithServer(ctx)).
+		Observe(time.Since(start).Seconds())
+}
@@ -7,7 +7,9 @@ import (
 
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
 	plugintest "github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
 )
 
@@ -227,6 +229,75 @@ func TestFinalizeFlattensCNAMEs(t *testing.T) {
 	}
 }
 
+// answerRecorder records the answers the rest of the plugin chain writes.
+type answerRecorder struct {
+	Next plugin.Handler
+	got  []*dns.Msg
+}
+
+func (h *answerRecorder) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	rec := dnstest.NewRecorder(w)
+	code, err := plugin.NextOrFailure(h.Name(), h.Next, ctx, rec, r)
+	if rec.Msg != nil {
+		h.got = append(h.got, rec.Msg.Copy())
+	}
+	return code, err
+}
+
+func (h *answerRecorder) Name() string { return "recorder" }
+
+func TestFinalizeLookupsAreNotFlattenedAgain(t *testing.T) {
+	// The server finalize looks up through has a finalize of its own, which
+	// must answer the lookups with the raw chain.
+	recorder := &answerRecorder{}
+	cfg := &dnsserver.Config{
+		Zone:        ".",
+		ListenHosts: []string{""},
+		Port:        "53",
+		Plugin: []plugin.Plugin{
+			func(next plugin.Handler) plugin.Handler {
+				recorder.Next = next
+				return recorder
+			},
+			func(next plugin.Handler) plugin.Handler {
+				inner := New()
+				inner.Next = next
+				return inner
+			},
+			func(next plugin.Handler) plugin.Handler {
+				return &captureHandler{}
+			},
+		},
+	}
+	server, err := dnsserver.NewServer("dns://:53", []*dnsserver.Config{cfg})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	ctx := context.WithValue(context.Background(), dnsserver.Key{}, server)
+	ctx = context.WithValue(ctx, dnsserver.LoopKey{}, 0)
+
+	finalize := New()
+	finalize.Next = cnameHandler{}
+
+	req := new(dns.Msg)
+	req.SetQuestion("foo.example.", dns.TypeA)
+	w := newCaptureResponseWriter()
+	if _, err := finalize.ServeDNS(ctx, w, req); err != nil {
+		t.Fatalf("finalize ServeDNS failed: %v", err)
+	}
+	if w.msg == nil || !allAnswersType(w.msg.Answer, dns.TypeA) {
+		t.Fatalf("expected a flattened answer, got: %v", w.msg)
+	}
+
+	if len(recorder.got) != 2 {
+		t.Fatalf("expected two lookups, got %d", len(recorder.got))
+	}
+	first := recorder.got[0]
+	if len(first.Answer) != 1 || first.Answer[0].Header().Rrtype != dns.TypeCNAME {
+		t.Fatalf("expected the raw CNAME of bar.example., got: %v", first.Answer)
+	}
+}
+
 func TestFinalizeFlattensMultipleARecords(t *testing.T) {
 	capture := &multiAHandler{}
 	cfg := &dnsserver.Config{
@@ -711,3 +782,795 @@ func TestMinTTL(t *testing.T) {
 		})
 	}
 }
+
+// dnameHandler returns a DNAME redirecting the whole corp.example. subtree, so
+// finalize must synthesize the target from the query name.
+type dnameHandler struct{}
+
+func (h dnameHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Answer = []dns.RR{
+		&dns.DNAME{
+			Hdr:    dns.RR_Header{Name: "corp.example.", Rrtype: dns.TypeDNAME, Class: dns.ClassINET, Ttl: 60},
+			Target: "corp.internal.",
+		},
+	}
+
+	_ = w.WriteMsg(m)
+	return dns.RcodeSuccess, nil
+}
+
+func (h dnameHandler) Name() string { return "dname" }
+
+// dnameCaptureHandler answers upstream lookups below corp.internal. with another
+// DNAME into edge.internal., where the final A record lives.
+type dnameCaptureHandler struct {
+	got []*dns.Msg
+}
+
+func (h *dnameCaptureHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	h.got = append(h.got, r.Copy())
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+
+	name := r.Question[0].Name
+	switch {
+	case dns.IsSubDomain("corp.internal.", name):
+		m.Answer = []dns.RR{
+			&dns.DNAME{
+				Hdr:    dns.RR_Header{Name: "corp.internal.", Rrtype: dns.TypeDNAME, Class: dns.ClassINET, Ttl: 60},
+				Target: "edge.internal.",
+			},
+		}
+	default:
+		m.Answer = []dns.RR{
+			&dns.A{
+				Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP("203.0.113.20"),
+			},
+		}
+	}
+
+	_ = w.WriteMsg(m)
+	return dns.RcodeSuccess, nil
+}
+
+func (h *dnameCaptureHandler) Name() string { return "dnameCapture" }
+
+func TestFinalizeFollowsDNAME(t *testing.T) {
+	capture := &dnameCaptureHandler{}
+	cfg := &dnsserver.Config{
+		Zone:        ".",
+		ListenHosts: []string{""},
+		Port:        "53",
+		Plugin: []plugin.Plugin{
+			func(next plugin.Handler) plugin.Handler {
+				return capture
+			},
+		},
+	}
+	server, err := dnsserver.NewServer("dns://:53", []*dnsserver.Config{cfg})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	finalize := New()
+	finalize.Next = dnameHandler{}
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.corp.example.", dns.TypeA)
+	req.RecursionDesired = true
+
+	ctx := context.WithValue(context.Background(), dnsserver.Key{}, server)
+	ctx = context.WithValue(ctx, dnsserver.LoopKey{}, 0)
+
+	w := newCaptureResponseWriter()
+	_, err = finalize.ServeDNS(ctx, w, req)
+	if err != nil {
+		t.Fatalf("finalize ServeDNS failed: %v", err)
+	}
+
+	if len(capture.got) != 2 {
+		t.Fatalf("expected two upstream lookups, got %d", len(capture.got))
+	}
+	assertUpstreamQuery(t, capture.got[0], "www.corp.internal.")
+	assertUpstreamQuery(t, capture.got[1], "www.edge.internal.")
+
+	if w.msg == nil {
+		t.Fatal("expected finalize to write a response")
+	}
+	if !allAnswersType(w.msg.Answer, dns.TypeA) {
+		t.Fatalf("expected only A records in final answer, got: %#v", w.msg.Answer)
+	}
+	if got := w.msg.Answer[0].Header().Name; got != "www.corp.example." {
+		t.Fatalf("expected answer name to be www.corp.example., got %q", got)
+	}
+}
+
+func TestAliasTarget(t *testing.T) {
+	tests := []struct {
+		name     string
+		rr       dns.RR
+		qname    string
+		expected string
+		ok       bool
+	}{
+		{
+			name:     "cname",
+			rr:       &dns.CNAME{Hdr: dns.RR_Header{Name: "foo.example.", Rrtype: dns.TypeCNAME}, Target: "bar.example."},
+			qname:    "foo.example.",
+			expected: "bar.example.",
+			ok:       true,
+		},
+		{
+			name:     "dname substitutes owner suffix",
+			rr:       &dns.DNAME{Hdr: dns.RR_Header{Name: "example.", Rrtype: dns.TypeDNAME}, Target: "example.net."},
+			qname:    "a.b.EXAMPLE.",
+			expected: "a.b.example.net.",
+			ok:       true,
+		},
+		{
+			name:  "dname owned by the root",
+			rr:    &dns.DNAME{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeDNAME}, Target: "example.net."},
+			qname: "foo.example.",
+		},
+		{
+			name:  "dname does not apply to its owner",
+			rr:    &dns.DNAME{Hdr: dns.RR_Header{Name: "example.", Rrtype: dns.TypeDNAME}, Target: "example.net."},
+			qname: "example.",
+		},
+		{
+			name:  "dname does not apply outside its subtree",
+			rr:    &dns.DNAME{Hdr: dns.RR_Header{Name: "example.", Rrtype: dns.TypeDNAME}, Target: "example.net."},
+			qname: "foo.example.org.",
+		},
+		{
+			name:  "unsupported type",
+			rr:    &dns.A{Hdr: dns.RR_Header{Name: "foo.example.", Rrtype: dns.TypeA}},
+			qname: "foo.example.",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, ok := aliasTarget(tt.rr, tt.qname)
+			if ok != tt.ok || target != tt.expected {
+				t.Errorf("expected (%q, %t), got (%q, %t)", tt.expected, tt.ok, target, ok)
+			}
+		})
+	}
+}
+
+// httpsAliasHandler returns an HTTPS record in AliasMode pointing at the CDN name.
+type httpsAliasHandler struct{}
+
+func (h httpsAliasHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Answer = []dns.RR{
+		mustRR("foo.example. 300 IN HTTPS 0 cdn.example."),
+	}
+
+	_ = w.WriteMsg(m)
+	return dns.RcodeSuccess, nil
+}
+
+func (h httpsAliasHandler) Name() string { return "httpsAlias" }
+
+// httpsServiceHandler answers upstream lookups with ServiceMode HTTPS records.
+type httpsServiceHandler struct {
+	got []*dns.Msg
+}
+
+func (h *httpsServiceHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	h.got = append(h.got, r.Copy())
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	m.Answer = []dns.RR{
+		mustRR(r.Question[0].Name + ` 60 IN HTTPS 1 . alpn="h2" ipv4hint="203.0.113.30"`),
+	}
+
+	_ = w.WriteMsg(m)
+	return dns.RcodeSuccess, nil
+}
+
+func (h *httpsServiceHandler) Name() string { return "httpsService" }
+
+func TestFinalizeFlattensHTTPSAlias(t *testing.T) {
+	capture := &httpsServiceHandler{}
+	cfg := &dnsserver.Config{
+		Zone:        ".",
+		ListenHosts: []string{""},
+		Port:        "53",
+		Plugin: []plugin.Plugin{
+			func(next plugin.Handler) plugin.Handler {
+				return capture
+			},
+		},
+	}
+	server, err := dnsserver.NewServer("dns://:53", []*dnsserver.Config{cfg})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	finalize := New()
+	finalize.Next = httpsAliasHandler{}
+
+	req := new(dns.Msg)
+	req.SetQuestion("foo.example.", dns.TypeHTTPS)
+	req.RecursionDesired = true
+
+	ctx := context.WithValue(context.Background(), dnsserver.Key{}, server)
+	ctx = context.WithValue(ctx, dnsserver.LoopKey{}, 0)
+
+	w := newCaptureResponseWriter()
+	_, err = finalize.ServeDNS(ctx, w, req)
+	if err != nil {
+		t.Fatalf("finalize ServeDNS failed: %v", err)
+	}
+
+	if len(capture.got) != 1 {
+		t.Fatalf("expected one upstream lookup, got %d", len(capture.got))
+	}
+	assertUpstreamQuery(t, capture.got[0], "cdn.example.")
+	if qtype := capture.got[0].Question[0].Qtype; qtype != dns.TypeHTTPS {
+		t.Fatalf("expected upstream lookup for HTTPS, got %s", dns.Type(qtype))
+	}
+
+	if w.msg == nil {
+		t.Fatal("expected finalize to write a response")
+	}
+	if len(w.msg.Answer) != 1 {
+		t.Fatalf("expected one HTTPS record in final answer, got: %#v", w.msg.Answer)
+	}
+	https, ok := w.msg.Answer[0].(*dns.HTTPS)
+	if !ok {
+		t.Fatalf("expected HTTPS record answer, got %T", w.msg.Answer[0])
+	}
+	if https.Hdr.Name != "foo.example." {
+		t.Fatalf("expected answer name to be foo.example., got %q", https.Hdr.Name)
+	}
+	if https.Priority != 1 || https.Target != "cdn.example." {
+		t.Fatalf("expected ServiceMode record targeting cdn.example., got %s", https)
+	}
+	if https.Hdr.Ttl != 60 {
+		t.Fatalf("expected TTL 60 (minimum in chain), got %d", https.Hdr.Ttl)
+	}
+}
+
+func mustRR(s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		panic(err)
+	}
+	return rr
+}
+
+// typedCaptureHandler answers every upstream lookup with a record of the
+// requested type, so finalize can flatten arbitrary query types.
+type typedCaptureHandler struct {
+	got []*dns.Msg
+}
+
+func (h *typedCaptureHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	h.got = append(h.got, r.Copy())
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+
+	name := r.Question[0].Name
+	switch r.Question[0].Qtype {
+	case dns.TypeTXT:
+		m.Answer = []dns.RR{mustRR(name + ` 60 IN TXT "v=spf1 -all"`)}
+	case dns.TypeMX:
+		m.Answer = []dns.RR{mustRR(name + ` 60 IN MX 10 mail.example.`)}
+	}
+
+	_ = w.WriteMsg(m)
+	return dns.RcodeSuccess, nil
+}
+
+func (h *typedCaptureHandler) Name() string { return "typedCapture" }
+
+func TestFinalizeFlattensConfiguredTypes(t *testing.T) {
+	capture := &typedCaptureHandler{}
+	cfg := &dnsserver.Config{
+		Zone:        ".",
+		ListenHosts: []string{""},
+		Port:        "53",
+		Plugin: []plugin.Plugin{
+			func(next plugin.Handler) plugin.Handler {
+				return capture
+			},
+		},
+	}
+	server, err := dnsserver.NewServer("dns://:53", []*dnsserver.Config{cfg})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	finalize := New()
+	finalize.types = map[uint16]struct{}{dns.TypeTXT: {}}
+	finalize.Next = cnameHandler{}
+
+	ctx := context.WithValue(context.Background(), dnsserver.Key{}, server)
+	ctx = context.WithValue(ctx, dnsserver.LoopKey{}, 0)
+
+	req := new(dns.Msg)
+	req.SetQuestion("foo.example.", dns.TypeTXT)
+	req.RecursionDesired = true
+
+	w := newCaptureResponseWriter()
+	_, err = finalize.ServeDNS(ctx, w, req)
+	if err != nil {
+		t.Fatalf("finalize ServeDNS failed: %v", err)
+	}
+	if w.msg == nil {
+		t.Fatal("expected finalize to write a response")
+	}
+	if !allAnswersType(w.msg.Answer, dns.TypeTXT) {
+		t.Fatalf("expected only TXT records in final answer, got: %#v", w.msg.Answer)
+	}
+	if got := w.msg.Answer[0].Header().Name; got != "foo.example." {
+		t.Fatalf("expected answer name to be foo.example., got %q", got)
+	}
+
+	// MX isn't configured, so the CNAME answer must be passed through untouched.
+	req = new(dns.Msg)
+	req.SetQuestion("foo.example.", dns.TypeMX)
+	req.RecursionDesired = true
+
+	lookups := len(capture.got)
+	w = newCaptureResponseWriter()
+	_, err = finalize.ServeDNS(ctx, w, req)
+	if err != nil {
+		t.Fatalf("finalize ServeDNS failed: %v", err)
+	}
+	if len(capture.got) != lookups {
+		t.Fatalf("expected no upstream lookups for MX, got %d", len(capture.got)-lookups)
+	}
+	if !allAnswersType(w.msg.Answer, dns.TypeCNAME) {
+		t.Fatalf("expected the original CNAME answer for MX, got: %#v", w.msg.Answer)
+	}
+}
+
+// unorderedAnswerHandler returns the chain foo -> bar -> baz out of order, an
+// unrelated A record next to it and no terminal record for baz.example.
+type unorderedAnswerHandler struct{}
+
+func (h unorderedAnswerHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Answer = []dns.RR{
+		mustRR("evil.example. 60 IN A 198.51.100.66"),
+		mustRR("bar.example. 60 IN CNAME baz.example."),
+		mustRR(r.Question[0].Name + " 60 IN CNAME bar.example."),
+	}
+
+	_ = w.WriteMsg(m)
+	return dns.RcodeSuccess, nil
+}
+
+func (h unorderedAnswerHandler) Name() string { return "unordered" }
+
+func TestFinalizeLinksChainInAnswer(t *testing.T) {
+	capture := &captureHandler{}
+	cfg := &dnsserver.Config{
+		Zone:        ".",
+		ListenHosts: []string{""},
+		Port:        "53",
+		Plugin: []plugin.Plugin{
+			func(next plugin.Handler) plugin.Handler {
+				return capture
+			},
+		},
+	}
+	server, err := dnsserver.NewServer("dns://:53", []*dnsserver.Config{cfg})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	finalize := New()
+	finalize.Next = unorderedAnswerHandler{}
+
+	req := new(dns.Msg)
+	req.SetQuestion("foo.example.", dns.TypeA)
+	req.RecursionDesired = true
+
+	ctx := context.WithValue(context.Background(), dnsserver.Key{}, server)
+	ctx = context.WithValue(ctx, dnsserver.LoopKey{}, 0)
+
+	w := newCaptureResponseWriter()
+	_, err = finalize.ServeDNS(ctx, w, req)
+	if err != nil {
+		t.Fatalf("finalize ServeDNS failed: %v", err)
+	}
+
+	// The partial chain must be continued at its last target instead of the
+	// first one, and the unrelated A record must not be used.
+	if len(capture.got) != 1 {
+		t.Fatalf("expected one upstream lookup, got %d", len(capture.got))
+	}
+	assertUpstreamQuery(t, capture.got[0], "baz.example.")
+
+	if w.msg == nil {
+		t.Fatal("expected finalize to write a response")
+	}
+	if len(w.msg.Answer) != 1 {
+		t.Fatalf("expected one A record in final answer, got: %#v", w.msg.Answer)
+	}
+	arec, ok := w.msg.Answer[0].(*dns.A)
+	if !ok {
+		t.Fatalf("expected A record answer, got %T", w.msg.Answer[0])
+	}
+	if arec.Hdr.Name != "foo.example." || arec.A.String() != "203.0.113.10" {
+		t.Fatalf("expected foo.example. A 203.0.113.10, got %s", arec)
+	}
+}
+
+func TestLinkChain(t *testing.T) {
+	rrs := []dns.RR{
+		mustRR("baz.example. 60 IN A 203.0.113.55"),
+		mustRR("other.example. 60 IN A 198.51.100.1"),
+		mustRR("bar.example. 60 IN CNAME baz.example."),
+		mustRR("foo.example. 60 IN CNAME bar.example."),
+	}
+
+	link := linkChain(rrs, "foo.example.", dns.TypeA, map[string]struct{}{"foo.example.": {}}, 0)
+	if len(link.hops) != 2 || link.name != "baz.example." {
+		t.Fatalf("expected two hops ending at baz.example., got %d hops ending at %s", len(link.hops), link.name)
+	}
+	if len(link.terminal) != 1 || link.terminal[0].(*dns.A).A.String() != "203.0.113.55" {
+		t.Fatalf("expected the terminal record of baz.example., got %v", link.terminal)
+	}
+
+	link = linkChain(rrs, "foo.example.", dns.TypeA, map[string]struct{}{"foo.example.": {}}, 1)
+	if len(link.hops) != 1 || link.name != "bar.example." || len(link.terminal) != 0 {
+		t.Fatalf("expected a single hop to bar.example., got %d hops ending at %s", len(link.hops), link.name)
+	}
+
+	loop := []dns.RR{
+		mustRR("foo.example. 60 IN CNAME bar.example."),
+		mustRR("bar.example. 60 IN CNAME foo.example."),
+	}
+	link = linkChain(loop, "foo.example.", dns.TypeA, map[string]struct{}{"foo.example.": {}}, 0)
+	if !link.circular {
+		t.Fatal("expected circular chain to be detected")
+	}
+
+	root := []dns.RR{mustRR(". 300 IN DNAME example.net.")}
+	link = linkChain(root, "foo.example.", dns.TypeA, map[string]struct{}{"foo.example.": {}}, 0)
+	if len(link.hops) != 0 || link.name != "foo.example." {
+		t.Fatalf("expected a DNAME owned by the root to be ignored, got %d hops ending at %s", len(link.hops), link.name)
+	}
+}
+
+func TestFinalizeMatchZones(t *testing.T) {
+	finalize := New()
+	finalize.zones = []string{"example.org.", "cdn.example."}
+	finalize.except = []string{"static.example.org."}
+
+	tests := []struct {
+		qname    string
+		targets  []string
+		expected string
+	}{
+		{qname: "www.example.org.", expected: "example.org."},
+		{qname: "static.example.org.", targets: []string{"edge.cdn.example."}},
+		{qname: "shop.customer.test.", targets: []string{"lb.customer.test.", "edge.cdn.example."}, expected: "cdn.example."},
+		{qname: "shop.customer.test.", targets: []string{"static.example.org."}},
+		{qname: "other.test.", targets: []string{"lb.other.test."}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.qname, func(t *testing.T) {
+			if zone := finalize.match(tt.qname, tt.targets); zone != tt.expected {
+				t.Errorf("expected zone %q, got %q", tt.expected, zone)
+			}
+		})
+	}
+}
+
+func TestFinalizeSkipsOutOfZone(t *testing.T) {
+	capture := &captureHandler{}
+	cfg := &dnsserver.Config{
+		Zone:        ".",
+		ListenHosts: []string{""},
+		Port:        "53",
+		Plugin: []plugin.Plugin{
+			func(next plugin.Handler) plugin.Handler {
+				return capture
+			},
+		},
+	}
+	server, err := dnsserver.NewServer("dns://:53", []*dnsserver.Config{cfg})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	finalize := New()
+	finalize.zones = []string{"example.org."}
+	finalize.Next = cnameHandler{}
+
+	req := new(dns.Msg)
+	req.SetQuestion("foo.example.", dns.TypeA)
+
+	ctx := context.WithValue(context.Background(), dnsserver.Key{}, server)
+	ctx = context.WithValue(ctx, dnsserver.LoopKey{}, 0)
+
+	w := newCaptureResponseWriter()
+	if _, err := finalize.ServeDNS(ctx, w, req); err != nil {
+		t.Fatalf("finalize ServeDNS failed: %v", err)
+	}
+	if len(capture.got) != 0 {
+		t.Fatalf("expected no upstream lookups, got %d", len(capture.got))
+	}
+	if w.msg == nil || !allAnswersType(w.msg.Answer, dns.TypeCNAME) {
+		t.Fatalf("expected the original CNAME answer, got: %v", w.msg)
+	}
+}
+
+// danglingHandler answers bar.example. with a CNAME to baz.example., which
+// doesn't exist. AAAA lookups get a NODATA answer instead of NXDOMAIN.
+type danglingHandler struct{}
+
+func (h danglingHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+
+	switch r.Question[0].Name {
+	case "bar.example.":
+		m.Answer = []dns.RR{
+			&dns.CNAME{
+				Hdr:    dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 3600},
+				Target: "baz.example.",
+			},
+		}
+	default:
+		if r.Question[0].Qtype != dns.TypeAAAA {
+			m.Rcode = dns.RcodeNameError
+		}
+		m.Ns = []dns.RR{
+			&dns.SOA{
+				Hdr:     dns.RR_Header{Name: "example.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+				Ns:      "ns.example.",
+				Mbox:    "hostmaster.example.",
+				Serial:  1,
+				Refresh: 7200,
+				Retry:   3600,
+				Expire:  1209600,
+				Minttl:  300,
+			},
+		}
+	}
+
+	_ = w.WriteMsg(m)
+	return m.Rcode, nil
+}
+
+func (h danglingHandler) Name() string { return "dangling" }
+
+func TestFinalizeOnFailure(t *testing.T) {
+	cfg := &dnsserver.Config{
+		Zone:        ".",
+		ListenHosts: []string{""},
+		Port:        "53",
+		Plugin: []plugin.Plugin{
+			func(next plugin.Handler) plugin.Handler {
+				return danglingHandler{}
+			},
+		},
+	}
+	server, err := dnsserver.NewServer("dns://:53", []*dnsserver.Config{cfg})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	ctx := context.WithValue(context.Background(), dnsserver.Key{}, server)
+	ctx = context.WithValue(ctx, dnsserver.LoopKey{}, 0)
+
+	tests := []struct {
+		name      string
+		onFailure map[outcome]int
+		rcode     int
+		answers   int
+	}{
+		{name: "default", onFailure: map[outcome]int{}, rcode: dns.RcodeSuccess, answers: 1},
+		{name: "original", onFailure: map[outcome]int{outcomeDangling: failureOriginal}, rcode: dns.RcodeSuccess, answers: 1},
+		{name: "servfail", onFailure: map[outcome]int{outcomeDangling: dns.RcodeServerFailure}, rcode: dns.RcodeServerFailure},
+		{name: "nxdomain", onFailure: map[outcome]int{outcomeDangling: dns.RcodeNameError}, rcode: dns.RcodeNameError},
+		{name: "other class", onFailure: map[outcome]int{outcomeCircular: dns.RcodeRefused}, rcode: dns.RcodeSuccess, answers: 1},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			finalize := New()
+			finalize.Next = cnameHandler{}
+			finalize.onFailure = tc.onFailure
+
+			req := new(dns.Msg)
+			req.SetQuestion("foo.example.", dns.TypeA)
+			req.SetEdns0(4096, false)
+
+			w := newCaptureResponseWriter()
+			rcode, err := finalize.ServeDNS(ctx, w, req)
+			if err != nil {
+				t.Fatalf("finalize ServeDNS failed: %v", err)
+			}
+			if rcode != dns.RcodeSuccess {
+				t.Fatalf("expected ServeDNS to report the response as written, got rcode %d", rcode)
+			}
+			if w.msg == nil {
+				t.Fatal("expected finalize to write a response")
+			}
+			if w.msg.Rcode != tc.rcode {
+				t.Fatalf("expected rcode %s, got %s", dns.RcodeToString[tc.rcode], dns.RcodeToString[w.msg.Rcode])
+			}
+			if len(w.msg.Answer) != tc.answers {
+				t.Fatalf("expected %d answers, got: %v", tc.answers, w.msg.Answer)
+			}
+			if len(w.msg.Question) != 1 || w.msg.Question[0].Name != "foo.example." {
+				t.Fatalf("expected the question to be kept, got: %v", w.msg.Question)
+			}
+		})
+	}
+}
+
+func TestFinalizeUpstreamFailureRcodes(t *testing.T) {
+	tests := []struct {
+		name      string
+		rcode     int
+		onFailure map[outcome]int
+		expected  int
+	}{
+		{name: "servfail isn't dangling", rcode: dns.RcodeServerFailure, onFailure: map[outcome]int{outcomeDangling: dns.RcodeNameError}, expected: dns.RcodeSuccess},
+		{name: "refused isn't dangling", rcode: dns.RcodeRefused, onFailure: map[outcome]int{outcomeDangling: failureNegative}, expected: dns.RcodeSuccess},
+		{name: "servfail is an upstream error", rcode: dns.RcodeServerFailure, onFailure: map[outcome]int{outcomeUpstreamError: dns.RcodeServerFailure}, expected: dns.RcodeServerFailure},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			finalize := New()
+			finalize.Next = cnameHandler{}
+			finalize.upstream = &rcodeLookuper{rcode: tc.rcode}
+			finalize.onFailure = tc.onFailure
+
+			req := new(dns.Msg)
+			req.SetQuestion("foo.example.", dns.TypeA)
+
+			w := newCaptureResponseWriter()
+			if _, err := finalize.ServeDNS(context.Background(), w, req); err != nil {
+				t.Fatalf("finalize ServeDNS failed: %v", err)
+			}
+			if w.msg == nil || w.msg.Rcode != tc.expected {
+				t.Fatalf("expected rcode %s, got: %v", dns.RcodeToString[tc.expected], w.msg)
+			}
+			if tc.expected == dns.RcodeSuccess && !allAnswersType(w.msg.Answer, dns.TypeCNAME) {
+				t.Fatalf("expected the original answer, got: %v", w.msg.Answer)
+			}
+		})
+	}
+}
+
+func TestApplyFailurePolicyNegative(t *testing.T) {
+	soa := mustRR("example. 3600 IN SOA ns.example. hostmaster.example. 1 7200 3600 1209600 300")
+	tests := []struct {
+		name     string
+		rcode    int
+		ns       []dns.RR
+		expected int
+		answers  int
+	}{
+		{name: "nxdomain", rcode: dns.RcodeNameError, ns: []dns.RR{soa}, expected: dns.RcodeNameError},
+		{name: "nodata", rcode: dns.RcodeSuccess, ns: []dns.RR{soa}, expected: dns.RcodeSuccess},
+		{name: "nxdomain without soa", rcode: dns.RcodeNameError, expected: dns.RcodeSuccess, answers: 1},
+		{name: "servfail", rcode: dns.RcodeServerFailure, ns: []dns.RR{soa}, expected: dns.RcodeSuccess, answers: 1},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			finalize := New()
+			finalize.onFailure = map[outcome]int{outcomeDangling: failureNegative}
+
+			r := new(dns.Msg)
+			r.SetQuestion("foo.example.", dns.TypeA)
+			r.Answer = []dns.RR{mustRR("foo.example. 60 IN CNAME bar.example.")}
+			neg := new(dns.Msg)
+			neg.SetQuestion("bar.example.", dns.TypeA)
+			neg.Rcode = tc.rcode
+			neg.Ns = tc.ns
+
+			finalize.applyFailurePolicy(r, result{outcome: outcomeDangling, negative: neg})
+			if r.Rcode != tc.expected || len(r.Answer) != tc.answers {
+				t.Fatalf("expected rcode %s with %d answers, got: %v", dns.RcodeToString[tc.expected], tc.answers, r)
+			}
+			if tc.answers == 0 && len(r.Ns) != 1 {
+				t.Fatalf("expected the SOA in the authority section, got: %v", r.Ns)
+			}
+		})
+	}
+}
+
+// rcodeLookuper answers all lookups with an empty response with rcode.
+type rcodeLookuper struct {
+	rcode int
+}
+
+func (l *rcodeLookuper) Lookup(ctx context.Context, state request.Request, name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.Response = true
+	m.Rcode = l.rcode
+	return m, nil
+}
+
+func TestFinalizeNegativeAnswer(t *testing.T) {
+	cfg := &dnsserver.Config{
+		Zone:        ".",
+		ListenHosts: []string{""},
+		Port:        "53",
+		Plugin: []plugin.Plugin{
+			func(next plugin.Handler) plugin.Handler {
+				return danglingHandler{}
+			},
+		},
+	}
+	server, err := dnsserver.NewServer("dns://:53", []*dnsserver.Config{cfg})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	ctx := context.WithValue(context.Background(), dnsserver.Key{}, server)
+	ctx = context.WithValue(ctx, dnsserver.LoopKey{}, 0)
+
+	tests := []struct {
+		name     string
+		qtype    uint16
+		cnameTTL uint32
+		rcode    int
+		ttl      uint32
+	}{
+		// The SOA MINIMUM of 300 is lower than the SOA TTL of 3600.
+		{name: "nxdomain", qtype: dns.TypeA, cnameTTL: 600, rcode: dns.RcodeNameError, ttl: 300},
+		{name: "nodata", qtype: dns.TypeAAAA, cnameTTL: 600, rcode: dns.RcodeSuccess, ttl: 300},
+		// The CNAME chain expires before the negative answer.
+		{name: "chain ttl", qtype: dns.TypeA, cnameTTL: 30, rcode: dns.RcodeNameError, ttl: 30},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			finalize := New()
+			finalize.Next = &ttlAwareCnameHandler{ttl: tc.cnameTTL}
+			finalize.onFailure = map[outcome]int{outcomeDangling: failureNegative}
+
+			req := new(dns.Msg)
+			req.SetQuestion("foo.example.", tc.qtype)
+
+			w := newCaptureResponseWriter()
+			if _, err := finalize.ServeDNS(ctx, w, req); err != nil {
+				t.Fatalf("finalize ServeDNS failed: %v", err)
+			}
+			if w.msg == nil {
+				t.Fatal("expected finalize to write a response")
+			}
+			if w.msg.Rcode != tc.rcode {
+				t.Fatalf("expected rcode %s, got %s", dns.RcodeToString[tc.rcode], dns.RcodeToString[w.msg.Rcode])
+			}
+			if len(w.msg.Answer) != 0 {
+				t.Fatalf("expected no answers, got: %v", w.msg.Answer)
+			}
+			if w.msg.Question[0].Name != "foo.example." {
+				t.Fatalf("expected the original question, got: %v", w.msg.Question)
+			}
+			if len(w.msg.Ns) != 1 || w.msg.Ns[0].Header().Rrtype != dns.TypeSOA {
+				t.Fatalf("expected the SOA of the last hop in the authority section, got: %v", w.msg.Ns)
+			}
+			if got := w.msg.Ns[0].Header().Ttl; got != tc.ttl {
+				t.Fatalf("expected negative TTL %d, got %d", tc.ttl, got)
+			}
+		})
+	}
+}
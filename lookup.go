@@ -0,0 +1,178 @@
+package finalize
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/plugin/metrics"
+	"github.com/coredns/coredns/plugin/pkg/cache"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// lookup resolves name via upstream. Failed lookups, and lookups answered
+// with SERVFAIL, are retried with a jittered backoff as long as retries are
+// left and the deadline of ctx allows. With TCP fallback enabled, truncated
+// answers and the retries of failed UDP lookups are sent over TCP. The
+// lookups are marked, so their answers aren't flattened once more when routed
+// through the plugin chain.
+func (s *Finalize) lookup(ctx context.Context, state request.Request, name string, qtype uint16) (*dns.Msg, error) {
+	ctx = context.WithValue(ctx, FinalizeLoopKey{}, true)
+	lookupCount.WithLabelValues(metrics.WithServer(ctx), lookupSource(ctx)).Inc()
+	defer recordLookupDuration(ctx, time.Now())
+	tcp := state.Proto() == "tcp"
+	retries := 0
+	for {
+		attemptState := state
+		if tcp && state.Proto() != "tcp" {
+			attemptState = request.Request{W: &tcpWriter{state.W}, Req: state.Req}
+		}
+		msg, err := s.lookupOnce(ctx, attemptState, name, qtype)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err == nil && msg.Truncated && !tcp && s.tcpFallback {
+			// Retrying a truncated answer over TCP doesn't count as retry.
+			log.Debugf("Lookup of %s was truncated; retrying over TCP", name)
+			tcp = true
+			continue
+		}
+		if err == nil && msg.Rcode != dns.RcodeServerFailure {
+			return msg, nil
+		}
+		if retries >= s.retries {
+			return msg, err
+		}
+
+		retries++
+		if s.tcpFallback {
+			tcp = true
+		}
+		wait := s.backoff(retries)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			log.Debugf("No time left to retry lookup of %s", name)
+			return msg, err
+		}
+		reason := "SERVFAIL"
+		if err != nil {
+			reason = err.Error()
+		}
+		log.Debugf("Lookup of %s failed: %s; retry %d in %v", name, reason, retries, wait)
+		retryCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// backoff returns the time to wait before the given retry, doubling the
+// configured backoff with every retry and adding up to 50% jitter either way.
+func (s *Finalize) backoff(retry int) time.Duration {
+	d := s.retryBackoff << (retry - 1)
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + rand.N(d)
+}
+
+// lookupOnce makes a single lookup of name. Concurrent lookups for the same
+// name, type, class, DO and CD bit, client subnet and transport are coalesced
+// into a single upstream query whose response is shared by all callers. A
+// caller stops waiting once the hop timeout or the deadline of its ctx passes,
+// which doesn't end the shared query for the other callers.
+func (s *Finalize) lookupOnce(ctx context.Context, state request.Request, name string, qtype uint16) (*dns.Msg, error) {
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	key := lookupKey(name, qtype, state.QClass(), state.Do(), state.Req.CheckingDisabled, subnetKey(clientSubnet(state.Req), 128), state.Proto())
+
+	type flight struct {
+		v      any
+		err    error
+		leader bool
+	}
+	// Lookups through the plugin chain don't necessarily honor the context,
+	// so the lookup runs in its own goroutine. It is shared by all callers
+	// and must not end with the context of the first one, so it only keeps
+	// its values and gets a hop timeout of its own. Each caller still stops
+	// waiting once its own context is done.
+	shared := context.WithoutCancel(ctx)
+	done := make(chan flight, 1)
+	go func() {
+		leader := false
+		v, err := s.inflight.Do(key, func() (any, error) {
+			leader = true
+			lookupCtx := shared
+			if s.timeout > 0 {
+				var cancel context.CancelFunc
+				lookupCtx, cancel = context.WithTimeout(shared, s.timeout)
+				defer cancel()
+			}
+			return s.upstream.Lookup(lookupCtx, state, name, qtype)
+		})
+		done <- flight{v: v, err: err, leader: leader}
+	}()
+
+	var f flight
+	select {
+	case f = <-done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if !f.leader {
+		coalescedLookupCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+		log.Debugf("Coalesced lookup for name=%s type=%s", name, dns.Type(qtype).String())
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	msg, _ := f.v.(*dns.Msg)
+	if msg == nil {
+		return nil, fmt.Errorf("no answer received for %s", name)
+	}
+	if !f.leader {
+		// The response is shared with the other callers.
+		msg = msg.Copy()
+	}
+	return msg, nil
+}
+
+// tcpWriter makes lookups use TCP by presenting the client as connected over
+// TCP.
+type tcpWriter struct {
+	dns.ResponseWriter
+}
+
+// RemoteAddr implements dns.ResponseWriter.
+func (w *tcpWriter) RemoteAddr() net.Addr {
+	return toTCPAddr(w.ResponseWriter.RemoteAddr())
+}
+
+// LocalAddr implements dns.ResponseWriter.
+func (w *tcpWriter) LocalAddr() net.Addr {
+	return toTCPAddr(w.ResponseWriter.LocalAddr())
+}
+
+func toTCPAddr(addr net.Addr) net.Addr {
+	if udp, ok := addr.(*net.UDPAddr); ok {
+		return &net.TCPAddr{IP: udp.IP, Port: udp.Port, Zone: udp.Zone}
+	}
+	return addr
+}
+
+func lookupKey(name string, qtype, qclass uint16, do, cd bool, subnet, proto string) uint64 {
+	return cache.Hash([]byte(strings.ToLower(name) + "/" + strconv.Itoa(int(qtype)) + "/" + strconv.Itoa(int(qclass)) + "/" + strconv.FormatBool(do) + "/" + strconv.FormatBool(cd) + "/" + subnet + "/" + proto))
+}
@@ -0,0 +1,369 @@
+package finalize
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// blockingHandler holds every upstream lookup until release is closed, so
+// concurrent queries pile up behind the first one.
+type blockingHandler struct {
+	calls   atomic.Int32
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (h *blockingHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	if h.calls.Add(1) == 1 {
+		close(h.entered)
+	}
+	<-h.release
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Answer = []dns.RR{mustRR(r.Question[0].Name + " 60 IN A 203.0.113.10")}
+
+	_ = w.WriteMsg(m)
+	return dns.RcodeSuccess, nil
+}
+
+func (h *blockingHandler) Name() string { return "blocking" }
+
+func TestFinalizeCoalescesLookups(t *testing.T) {
+	upstream := &blockingHandler{entered: make(chan struct{}), release: make(chan struct{})}
+	cfg := &dnsserver.Config{
+		Zone:        ".",
+		ListenHosts: []string{""},
+		Port:        "53",
+		Plugin: []plugin.Plugin{
+			func(next plugin.Handler) plugin.Handler {
+				return upstream
+			},
+		},
+	}
+	server, err := dnsserver.NewServer("dns://:53", []*dnsserver.Config{cfg})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	finalize := New()
+	finalize.Next = cnameHandler{}
+
+	ctx := context.WithValue(context.Background(), dnsserver.Key{}, server)
+	ctx = context.WithValue(ctx, dnsserver.LoopKey{}, 0)
+
+	const clients = 10
+	var wg sync.WaitGroup
+	writers := make([]*captureResponseWriter, clients)
+	for i := range writers {
+		writers[i] = newCaptureResponseWriter()
+		wg.Add(1)
+		go func(w *captureResponseWriter) {
+			defer wg.Done()
+			req := new(dns.Msg)
+			req.SetQuestion("foo.example.", dns.TypeA)
+			if _, err := finalize.ServeDNS(ctx, w, req); err != nil {
+				t.Errorf("finalize ServeDNS failed: %v", err)
+			}
+		}(writers[i])
+	}
+
+	<-upstream.entered
+	// Give the remaining clients time to join the in-flight lookup.
+	time.Sleep(100 * time.Millisecond)
+	close(upstream.release)
+	wg.Wait()
+
+	if calls := upstream.calls.Load(); calls != 1 {
+		t.Fatalf("expected one upstream lookup, got %d", calls)
+	}
+	for _, w := range writers {
+		if w.msg == nil || !allAnswersType(w.msg.Answer, dns.TypeA) {
+			t.Fatalf("expected flattened A answer for every client, got: %v", w.msg)
+		}
+		if got := w.msg.Answer[0].Header().Name; got != "foo.example." {
+			t.Fatalf("expected answer name to be foo.example., got %q", got)
+		}
+	}
+}
+
+// releaseLookuper holds every lookup until release is closed or the context
+// of the lookup is done.
+type releaseLookuper struct {
+	entered chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (l *releaseLookuper) Lookup(ctx context.Context, state request.Request, name string, qtype uint16) (*dns.Msg, error) {
+	l.once.Do(func() { close(l.entered) })
+	select {
+	case <-l.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.Response = true
+	m.Answer = []dns.RR{mustRR(name + " 60 IN A 203.0.113.10")}
+	return m, nil
+}
+
+func TestFinalizeCoalescedLookupOutlivesCaller(t *testing.T) {
+	upstream := &releaseLookuper{entered: make(chan struct{}), release: make(chan struct{})}
+	finalize := New()
+	finalize.upstream = upstream
+
+	req := new(dns.Msg)
+	req.SetQuestion("foo.example.", dns.TypeA)
+	state := request.Request{W: newCaptureResponseWriter(), Req: req}
+
+	// The first caller gives up before the lookup is answered.
+	leaderCtx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	leader := make(chan error, 1)
+	go func() {
+		_, err := finalize.lookupOnce(leaderCtx, state, "bar.example.", dns.TypeA)
+		leader <- err
+	}()
+	<-upstream.entered
+
+	type answer struct {
+		msg *dns.Msg
+		err error
+	}
+	follower := make(chan answer, 1)
+	go func() {
+		msg, err := finalize.lookupOnce(context.Background(), state, "bar.example.", dns.TypeA)
+		follower <- answer{msg: msg, err: err}
+	}()
+
+	if err := <-leader; !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the first caller to time out, got: %v", err)
+	}
+	close(upstream.release)
+
+	got := <-follower
+	if got.err != nil {
+		t.Fatalf("expected the second caller to get the answer, got: %v", got.err)
+	}
+	if !allAnswersType(got.msg.Answer, dns.TypeA) {
+		t.Fatalf("expected an A answer, got: %v", got.msg.Answer)
+	}
+}
+
+// slowHandler answers like captureHandler, but only after delay.
+type slowHandler struct {
+	delay time.Duration
+}
+
+func (h slowHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	time.Sleep(h.delay)
+	return (&captureHandler{}).ServeDNS(ctx, w, r)
+}
+
+func (h slowHandler) Name() string { return "slow" }
+
+func TestFinalizeTimeouts(t *testing.T) {
+	cfg := &dnsserver.Config{
+		Zone:        ".",
+		ListenHosts: []string{""},
+		Port:        "53",
+		Plugin: []plugin.Plugin{
+			func(next plugin.Handler) plugin.Handler {
+				return slowHandler{delay: 50 * time.Millisecond}
+			},
+		},
+	}
+	server, err := dnsserver.NewServer("dns://:53", []*dnsserver.Config{cfg})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	ctx := context.WithValue(context.Background(), dnsserver.Key{}, server)
+	ctx = context.WithValue(ctx, dnsserver.LoopKey{}, 0)
+
+	// The chain needs two lookups of 50ms each.
+	tests := []struct {
+		name      string
+		timeout   time.Duration
+		deadline  time.Duration
+		flattened bool
+	}{
+		{name: "no limits", flattened: true},
+		{name: "hop timeout", timeout: 10 * time.Millisecond},
+		{name: "chain deadline", timeout: 80 * time.Millisecond, deadline: 80 * time.Millisecond},
+		{name: "within limits", timeout: time.Second, deadline: 2 * time.Second, flattened: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			finalize := New()
+			finalize.Next = cnameHandler{}
+			finalize.timeout = tc.timeout
+			finalize.deadline = tc.deadline
+
+			req := new(dns.Msg)
+			req.SetQuestion("foo.example.", dns.TypeA)
+
+			w := newCaptureResponseWriter()
+			start := time.Now()
+			if _, err := finalize.ServeDNS(ctx, w, req); err != nil {
+				t.Fatalf("finalize ServeDNS failed: %v", err)
+			}
+			elapsed := time.Since(start)
+			if w.msg == nil {
+				t.Fatal("expected finalize to write a response")
+			}
+			if tc.flattened {
+				if !allAnswersType(w.msg.Answer, dns.TypeA) {
+					t.Fatalf("expected a flattened answer, got: %v", w.msg.Answer)
+				}
+				return
+			}
+			if !allAnswersType(w.msg.Answer, dns.TypeCNAME) {
+				t.Fatalf("expected the original answer after the timeout, got: %v", w.msg.Answer)
+			}
+			if elapsed >= 100*time.Millisecond {
+				t.Fatalf("expected finalize to give up within the time budget, took %v", elapsed)
+			}
+		})
+	}
+}
+
+// flakyLookuper fails the first failures lookups, with an error or, if
+// servfail is set, a SERVFAIL answer. The transport of every lookup is
+// recorded.
+type flakyLookuper struct {
+	mu       sync.Mutex
+	failures int
+	servfail bool
+	protos   []string
+}
+
+func (l *flakyLookuper) Lookup(ctx context.Context, state request.Request, name string, qtype uint16) (*dns.Msg, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.protos = append(l.protos, state.Proto())
+
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.Response = true
+	if len(l.protos) <= l.failures {
+		if !l.servfail {
+			return nil, errors.New("connection refused")
+		}
+		m.Rcode = dns.RcodeServerFailure
+		return m, nil
+	}
+	m.Answer = []dns.RR{mustRR(name + " 60 IN A 203.0.113.10")}
+	return m, nil
+}
+
+func TestFinalizeRetries(t *testing.T) {
+	tests := []struct {
+		name        string
+		failures    int
+		servfail    bool
+		retries     int
+		tcpFallback bool
+		deadline    time.Duration
+		flattened   bool
+		protos      []string
+	}{
+		{name: "no retries", failures: 1, protos: []string{"udp"}},
+		{name: "retried", failures: 2, retries: 2, flattened: true, protos: []string{"udp", "udp", "udp"}},
+		{name: "retried servfail", failures: 1, servfail: true, retries: 1, flattened: true, protos: []string{"udp", "udp"}},
+		{name: "retries exhausted", failures: 3, retries: 2, protos: []string{"udp", "udp", "udp"}},
+		{name: "tcp fallback", failures: 1, retries: 1, tcpFallback: true, flattened: true, protos: []string{"udp", "tcp"}},
+		{name: "beyond deadline", failures: 1, retries: 1, deadline: 5 * time.Millisecond, protos: []string{"udp"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			upstream := &flakyLookuper{failures: tc.failures, servfail: tc.servfail}
+			finalize := New()
+			finalize.Next = cnameHandler{}
+			finalize.upstream = upstream
+			finalize.retries = tc.retries
+			finalize.retryBackoff = 10 * time.Millisecond
+			finalize.tcpFallback = tc.tcpFallback
+			finalize.deadline = tc.deadline
+
+			req := new(dns.Msg)
+			req.SetQuestion("foo.example.", dns.TypeA)
+
+			w := newCaptureResponseWriter()
+			if _, err := finalize.ServeDNS(context.Background(), w, req); err != nil {
+				t.Fatalf("finalize ServeDNS failed: %v", err)
+			}
+			if w.msg == nil {
+				t.Fatal("expected finalize to write a response")
+			}
+			if got := allAnswersType(w.msg.Answer, dns.TypeA); got != tc.flattened {
+				t.Fatalf("expected flattened=%v, got: %v", tc.flattened, w.msg.Answer)
+			}
+			if !slices.Equal(upstream.protos, tc.protos) {
+				t.Fatalf("expected lookups over %v, got %v", tc.protos, upstream.protos)
+			}
+		})
+	}
+}
+
+// truncatingLookuper answers lookups over UDP with an empty, truncated
+// response.
+type truncatingLookuper struct {
+	flakyLookuper
+}
+
+func (l *truncatingLookuper) Lookup(ctx context.Context, state request.Request, name string, qtype uint16) (*dns.Msg, error) {
+	m, err := l.flakyLookuper.Lookup(ctx, state, name, qtype)
+	if err == nil && state.Proto() == "udp" {
+		m.Answer = nil
+		m.Truncated = true
+	}
+	return m, err
+}
+
+func TestFinalizeTruncatedTCPFallback(t *testing.T) {
+	upstream := &truncatingLookuper{}
+	finalize := New()
+	finalize.Next = cnameHandler{}
+	finalize.upstream = upstream
+	finalize.tcpFallback = true
+
+	req := new(dns.Msg)
+	req.SetQuestion("foo.example.", dns.TypeA)
+
+	w := newCaptureResponseWriter()
+	if _, err := finalize.ServeDNS(context.Background(), w, req); err != nil {
+		t.Fatalf("finalize ServeDNS failed: %v", err)
+	}
+	if w.msg == nil || !allAnswersType(w.msg.Answer, dns.TypeA) {
+		t.Fatalf("expected flattened A answer, got: %v", w.msg)
+	}
+	if want := []string{"udp", "tcp"}; !slices.Equal(upstream.protos, want) {
+		t.Fatalf("expected lookups over %v, got %v", want, upstream.protos)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	finalize := New()
+	finalize.retryBackoff = 100 * time.Millisecond
+	for retry, base := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond} {
+		for range 20 {
+			d := finalize.backoff(retry + 1)
+			if d < base/2 || d >= base*3/2 {
+				t.Fatalf("expected backoff of retry %d within [%v, %v), got %v", retry+1, base/2, base*3/2, d)
+			}
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package finalize
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/coredns/coredns/plugin/metadata"
+	"github.com/coredns/coredns/request"
+)
+
+// report is the result of finalizing a single query, provided as metadata.
+type report struct {
+	// resolved is set once a chain was resolved for the query.
+	resolved bool
+	outcome  outcome
+	chain    []chainHop
+	// ttl is the TTL of the flattened answer, if any.
+	ttl    uint32
+	hasTTL bool
+}
+
+// reportKey is the context key of the report of a query.
+type reportKey struct{}
+
+// Metadata implements the metadata.Provider interface. The values are empty
+// unless a chain was resolved for the query.
+func (s *Finalize) Metadata(ctx context.Context, state request.Request) context.Context {
+	rep := new(report)
+	metadata.SetValueFunc(ctx, "finalize/outcome", func() string {
+		return string(rep.outcome)
+	})
+	metadata.SetValueFunc(ctx, "finalize/depth", func() string {
+		if !rep.resolved {
+			return ""
+		}
+		return strconv.Itoa(len(rep.chain))
+	})
+	metadata.SetValueFunc(ctx, "finalize/chain", func() string {
+		if !rep.resolved {
+			return ""
+		}
+		return formatChain(rep.chain)
+	})
+	metadata.SetValueFunc(ctx, "finalize/ttl", func() string {
+		if !rep.hasTTL {
+			return ""
+		}
+		return strconv.FormatUint(uint64(rep.ttl), 10)
+	})
+	return context.WithValue(ctx, reportKey{}, rep)
+}
+
+// record stores the result res of the chain in the report of the query
+// carried by ctx, if any.
+func record(ctx context.Context, res result) {
+	rep, ok := ctx.Value(reportKey{}).(*report)
+	if !ok {
+		return
+	}
+	rep.resolved = true
+	rep.outcome = res.outcome
+	rep.chain = res.chain
+	if len(res.answers) > 0 && !res.outcome.failed() {
+		rep.ttl = res.answers[0].Header().Ttl
+		rep.hasTTL = true
+	}
+}
+
+// formatChain returns the names of chain, from the query name to the last
+// target, separated by ">".
+func formatChain(chain []chainHop) string {
+	if len(chain) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(chain)+1)
+	names = append(names, chain[0].name)
+	for _, hop := range chain {
+		names = append(names, hop.target)
+	}
+	return strings.Join(names, ">")
+}
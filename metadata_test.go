@@ -0,0 +1,80 @@
+package finalize
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/metadata"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+func TestFinalizeMetadata(t *testing.T) {
+	tests := []struct {
+		name     string
+		upstream lookuper
+		qtype    uint16
+		want     map[string]string
+	}{
+		{
+			name:     "flattened",
+			upstream: &countingLookuper{},
+			qtype:    dns.TypeA,
+			want: map[string]string{
+				"finalize/outcome": "flattened",
+				"finalize/depth":   "1",
+				"finalize/chain":   "foo.example.>bar.example.",
+				"finalize/ttl":     "60",
+			},
+		},
+		{
+			name:     "upstream error",
+			upstream: &flakyLookuper{failures: 1},
+			qtype:    dns.TypeA,
+			want: map[string]string{
+				"finalize/outcome": "upstream_error",
+				"finalize/depth":   "1",
+				"finalize/chain":   "foo.example.>bar.example.",
+				"finalize/ttl":     "",
+			},
+		},
+		{
+			name:     "not flattened",
+			upstream: &countingLookuper{},
+			qtype:    dns.TypeTXT,
+			want: map[string]string{
+				"finalize/outcome": "",
+				"finalize/depth":   "",
+				"finalize/chain":   "",
+				"finalize/ttl":     "",
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			finalize := New()
+			finalize.Next = cnameHandler{}
+			finalize.upstream = tc.upstream
+
+			req := new(dns.Msg)
+			req.SetQuestion("foo.example.", tc.qtype)
+			w := newCaptureResponseWriter()
+
+			ctx := metadata.ContextWithMetadata(context.Background())
+			ctx = finalize.Metadata(ctx, request.Request{W: w, Req: req})
+			if _, err := finalize.ServeDNS(ctx, w, req); err != nil {
+				t.Fatalf("finalize ServeDNS failed: %v", err)
+			}
+
+			for label, want := range tc.want {
+				f := metadata.ValueFunc(ctx, label)
+				if f == nil {
+					t.Fatalf("expected metadata %s to be set", label)
+				}
+				if got := f(); got != want {
+					t.Errorf("expected metadata %s to be %q, got %q", label, want, got)
+				}
+			}
+		})
+	}
+}
@@ -17,32 +17,122 @@ var requestCount = promauto.NewCounterVec(prometheus.CounterOpts{
 	Help:      "Counter of requests processed.",
 }, []string{"server"})
 
+// resolutionCount counts the queries whose chain was resolved, by query type,
+// outcome and the configured zone the query matched.
+var resolutionCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "finalize",
+	Name:      "resolutions_total",
+	Help:      "Counter of resolved CNAME chains by query type, outcome and zone.",
+}, []string{"server", "qtype", "outcome", "zone"})
+
+// Deprecated: circularReferenceCount is kept as alias of resolutionCount with outcome circular.
 var circularReferenceCount = promauto.NewCounterVec(prometheus.CounterOpts{
 	Namespace: plugin.Namespace,
 	Subsystem: "finalize",
 	Name:      "circular_reference_count_total",
-	Help:      "Counter of detected circular references.",
+	Help:      "Deprecated, use resolutions_total{outcome=\"circular\"}. Counter of detected circular references.",
 }, []string{"server"})
 
+// Deprecated: danglingCNameCount is kept as alias of resolutionCount with outcome dangling.
 var danglingCNameCount = promauto.NewCounterVec(prometheus.CounterOpts{
 	Namespace: plugin.Namespace,
 	Subsystem: "finalize",
 	Name:      "dangling_cname_count_total",
-	Help:      "Counter of CNAMES that couldn't be resolved.",
+	Help:      "Deprecated, use resolutions_total{outcome=\"dangling\"}. Counter of CNAMES that couldn't be resolved.",
 }, []string{"server"})
 
+// Deprecated: maxDepthReachedCount is kept as alias of resolutionCount with outcome max_depth.
 var maxDepthReachedCount = promauto.NewCounterVec(prometheus.CounterOpts{
 	Namespace: plugin.Namespace,
 	Subsystem: "finalize",
 	Name:      "maxdepth_reached_count_total",
-	Help:      "Counter of incidents when max depth is reached while trying to resolve a CNAME.",
+	Help:      "Deprecated, use resolutions_total{outcome=\"max_depth\"}. Counter of incidents when max depth is reached while trying to resolve a CNAME.",
 }, []string{"server"})
 
+// Deprecated: upstreamErrorCount is kept as alias of resolutionCount with outcome upstream_error.
 var upstreamErrorCount = promauto.NewCounterVec(prometheus.CounterOpts{
 	Namespace: plugin.Namespace,
 	Subsystem: "finalize",
 	Name:      "upstream_error_count_total",
-	Help:      "Counter of upstream errors received.",
+	Help:      "Deprecated, use resolutions_total{outcome=\"upstream_error\"}. Counter of upstream errors received.",
+}, []string{"server"})
+
+var timeoutCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "finalize",
+	Name:      "timeouts_total",
+	Help:      "Counter of lookups abandoned due to the hop timeout or the chain deadline.",
+}, []string{"server"})
+
+var retryCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "finalize",
+	Name:      "retries_total",
+	Help:      "Counter of retried lookups of CNAME targets.",
+}, []string{"server"})
+
+var cacheHitCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "finalize",
+	Name:      "cache_hits_total",
+	Help:      "Counter of resolved CNAME chains served from the cache.",
+}, []string{"server"})
+
+var cacheMissCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "finalize",
+	Name:      "cache_misses_total",
+	Help:      "Counter of CNAME chain lookups not found in the cache.",
+}, []string{"server"})
+
+var cacheEvictionCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "finalize",
+	Name:      "cache_evictions_total",
+	Help:      "Counter of cache entries evicted to make room for new ones.",
+}, []string{"server"})
+
+var staleAnswerCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "finalize",
+	Name:      "stale_answers_total",
+	Help:      "Counter of chains answered from expired cache entries after a failed lookup.",
+}, []string{"server"})
+
+var prefetchCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "finalize",
+	Name:      "prefetches_total",
+	Help:      "Counter of chains resolved in the background to renew their cache entries.",
+}, []string{"server"})
+
+var lookupCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "finalize",
+	Name:      "lookups_total",
+	Help:      "Counter of lookups of CNAME targets, by whether they were made for a client query or a prefetch.",
+}, []string{"server", "source"})
+
+var coalescedLookupCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "finalize",
+	Name:      "coalesced_lookups_total",
+	Help:      "Counter of upstream lookups coalesced with an identical in-flight lookup.",
+}, []string{"server"})
+
+var resolverFailureCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "finalize",
+	Name:      "resolver_failures_total",
+	Help:      "Counter of failed lookups per dedicated resolver.",
+}, []string{"server", "resolver"})
+
+var validationFailureCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "finalize",
+	Name:      "validation_failures_total",
+	Help:      "Counter of chains which failed DNSSEC validation.",
 }, []string{"server"})
 
 var requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
@@ -53,4 +143,31 @@ var requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
 	Help:      "Histogram of the time each request took.",
 }, []string{"server"})
 
+var chainDepth = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "finalize",
+	Name:      "chain_depth",
+	Buckets:   depthBuckets,
+	Help:      "Histogram of the number of aliases followed per request, by outcome.",
+}, []string{"server", "outcome"})
+
+var lookupsPerQuery = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "finalize",
+	Name:      "lookups_per_request",
+	Buckets:   depthBuckets,
+	Help:      "Histogram of the number of upstream lookups per request, by outcome.",
+}, []string{"server", "outcome"})
+
+var lookupDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "finalize",
+	Name:      "lookup_duration_seconds",
+	Buckets:   plugin.TimeBuckets,
+	Help:      "Histogram of the time each upstream lookup took, including retries.",
+}, []string{"server"})
+
+// depthBuckets are the buckets of the histograms counting hops or lookups.
+var depthBuckets = []float64{0, 1, 2, 3, 4, 5, 6, 8, 10, 15, 20}
+
 var _ sync.Once
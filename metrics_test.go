@@ -0,0 +1,97 @@
+package finalize
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestResolutionCount(t *testing.T) {
+	tests := []struct {
+		name     string
+		upstream lookuper
+		qtype    uint16
+		outcome  outcome
+		// alias is the deprecated counter of the outcome, if any.
+		alias *prometheus.CounterVec
+	}{
+		{name: "flattened", upstream: &countingLookuper{}, qtype: dns.TypeA, outcome: outcomeFlattened},
+		{name: "dangling", upstream: &countingLookuper{}, qtype: dns.TypeAAAA, outcome: outcomeDangling, alias: danglingCNameCount},
+		{name: "dangling without answer", upstream: &rcodeLookuper{rcode: dns.RcodeNameError}, qtype: dns.TypeA, outcome: outcomeDangling, alias: danglingCNameCount},
+		{name: "upstream error", upstream: &flakyLookuper{failures: 1}, qtype: dns.TypeA, outcome: outcomeUpstreamError, alias: upstreamErrorCount},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			finalize := New()
+			finalize.Next = cnameHandler{}
+			finalize.upstream = tc.upstream
+			finalize.zones = []string{"example.org.", "example."}
+
+			counter := resolutionCount.WithLabelValues("", dns.Type(tc.qtype).String(), string(tc.outcome), "example.")
+			before := testutil.ToFloat64(counter)
+			aliasBefore := 0.0
+			if tc.alias != nil {
+				aliasBefore = testutil.ToFloat64(tc.alias.WithLabelValues(""))
+			}
+
+			req := new(dns.Msg)
+			req.SetQuestion("foo.example.", tc.qtype)
+			if _, err := finalize.ServeDNS(context.Background(), newCaptureResponseWriter(), req); err != nil {
+				t.Fatalf("finalize ServeDNS failed: %v", err)
+			}
+
+			if got := testutil.ToFloat64(counter) - before; got != 1 {
+				t.Fatalf("expected one resolution with outcome %s, got %v", tc.outcome, got)
+			}
+			if tc.alias != nil {
+				if got := testutil.ToFloat64(tc.alias.WithLabelValues("")) - aliasBefore; got != 1 {
+					t.Fatalf("expected the deprecated counter of outcome %s to count one, got %v", tc.outcome, got)
+				}
+			}
+		})
+	}
+}
+
+func TestChainHistograms(t *testing.T) {
+	finalize := New()
+	finalize.Next = cnameHandler{}
+	finalize.upstream = &countingLookuper{}
+	finalize.cache = newChainCache(16, defaultCacheMaxTTL)
+
+	// The query resolves foo.example. via bar.example., once via upstream and
+	// once from the cache.
+	depth := chainDepth.WithLabelValues("", string(outcomeFlattened))
+	lookups := lookupsPerQuery.WithLabelValues("", string(outcomeFlattened))
+	depthCount, depthSum := histogramSample(t, depth)
+	lookupsCount, lookupsSum := histogramSample(t, lookups)
+	for range 2 {
+		req := new(dns.Msg)
+		req.SetQuestion("foo.example.", dns.TypeA)
+		if _, err := finalize.ServeDNS(context.Background(), newCaptureResponseWriter(), req); err != nil {
+			t.Fatalf("finalize ServeDNS failed: %v", err)
+		}
+	}
+
+	count, sum := histogramSample(t, depth)
+	if count-depthCount != 2 || sum-depthSum != 2 {
+		t.Fatalf("expected two observations of one hop, got %d observations summing up to %v", count-depthCount, sum-depthSum)
+	}
+	count, sum = histogramSample(t, lookups)
+	if count-lookupsCount != 2 || sum-lookupsSum != 1 {
+		t.Fatalf("expected two observations of one lookup in total, got %d observations summing up to %v", count-lookupsCount, sum-lookupsSum)
+	}
+}
+
+// histogramSample returns the sample count and sum of the histogram o.
+func histogramSample(t *testing.T, o prometheus.Observer) (uint64, float64) {
+	t.Helper()
+	var m dto.Metric
+	if err := o.(prometheus.Metric).Write(&m); err != nil {
+		t.Fatalf("failed to read histogram: %v", err)
+	}
+	return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+}
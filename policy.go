@@ -0,0 +1,133 @@
+package finalize
+
+import (
+	"github.com/miekg/dns"
+)
+
+// outcome classifies how finalizing a query ended.
+type outcome string
+
+const (
+	// outcomeFlattened means the chain was resolved and flattened.
+	outcomeFlattened outcome = "flattened"
+	// outcomeTerminalReused means the terminal records of the original
+	// answer were flattened without upstream lookups.
+	outcomeTerminalReused outcome = "terminal_reused"
+	// outcomeDangling means the last target of the chain has no records of
+	// the query type.
+	outcomeDangling outcome = "dangling"
+	// outcomeCircular means the chain points back to a name already visited.
+	outcomeCircular outcome = "circular"
+	// outcomeMaxDepth means max_depth was reached before the chain ended.
+	outcomeMaxDepth outcome = "max_depth"
+	// outcomeUpstreamError means an upstream lookup failed.
+	outcomeUpstreamError outcome = "upstream_error"
+	// outcomeTimeout means the hop timeout or the chain deadline passed.
+	outcomeTimeout outcome = "timeout"
+	// outcomeBogus means a part of the chain failed DNSSEC validation.
+	outcomeBogus outcome = "bogus"
+	// outcomeSigned means a signed chain wasn't flattened due to the DNSSEC
+	// policy.
+	outcomeSigned outcome = "signed"
+	// outcomeStale means the chain was answered from an expired cache entry
+	// after a failed lookup.
+	outcomeStale outcome = "stale"
+)
+
+// failed reports whether o is a failure the failure policy applies to.
+func (o outcome) failed() bool {
+	_, ok := failureClasses[string(o)]
+	return ok
+}
+
+// failureClasses are the outcomes on_failure can be configured for.
+var failureClasses = map[string]outcome{
+	string(outcomeDangling):      outcomeDangling,
+	string(outcomeCircular):      outcomeCircular,
+	string(outcomeMaxDepth):      outcomeMaxDepth,
+	string(outcomeUpstreamError): outcomeUpstreamError,
+	string(outcomeBogus):         outcomeBogus,
+	string(outcomeTimeout):       outcomeTimeout,
+}
+
+const (
+	// failureOriginal keeps the original answer on failure.
+	failureOriginal = -1
+	// failureNegative returns the negative answer for the last target of a
+	// dangling chain under the query name.
+	failureNegative = -2
+)
+
+// failureActions maps the on_failure actions to the rcode of the response.
+var failureActions = map[string]int{
+	"original": failureOriginal,
+	"servfail": dns.RcodeServerFailure,
+	"refused":  dns.RcodeRefused,
+	"nxdomain": dns.RcodeNameError,
+	"negative": failureNegative,
+}
+
+// applyFailurePolicy rewrites the response r according to the action
+// configured for the failed result res. Without a configured action, or with
+// original, r is left untouched. Otherwise all records but the OPT record are
+// dropped and the configured rcode is set, or, for negative, the rcode and
+// SOA of the negative answer.
+func (s *Finalize) applyFailurePolicy(r *dns.Msg, res result) {
+	rcode, ok := s.onFailure[res.outcome]
+	if !ok || rcode == failureOriginal {
+		return
+	}
+
+	var ns []dns.RR
+	if rcode == failureNegative {
+		// Only NXDOMAIN and NODATA responses with a SOA make a cacheable
+		// negative answer (RFC 2308).
+		if res.negative == nil || (res.negative.Rcode != dns.RcodeSuccess && res.negative.Rcode != dns.RcodeNameError) {
+			log.Debugf("No negative answer for outcome %s; returning original answer", res.outcome)
+			return
+		}
+		ns = negativeAuthority(res.negative, res.ttls)
+		if len(ns) == 0 {
+			log.Debugf("Negative answer for outcome %s has no SOA; returning original answer", res.outcome)
+			return
+		}
+		rcode = res.negative.Rcode
+	}
+
+	r.Rcode = rcode
+	r.AuthenticatedData = false
+	r.Answer = nil
+	r.Ns = ns
+	extra := r.Extra[:0]
+	for _, rr := range r.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	r.Extra = extra
+}
+
+// negativeAuthority returns the SOA records of the negative response neg with
+// their TTL set to the negative caching TTL. Following RFC 2308 this is the
+// minimum of the SOA TTL and its MINIMUM field, further limited by the
+// minimum TTL of the aliases leading to the negative answer.
+func negativeAuthority(neg *dns.Msg, ttls chainTTLs) []dns.RR {
+	var ns []dns.RR
+	for _, rr := range neg.Ns {
+		soa, ok := rr.(*dns.SOA)
+		if !ok {
+			continue
+		}
+		soa = dns.Copy(soa).(*dns.SOA)
+		ttl := soa.Hdr.Ttl
+		if soa.Minttl < ttl {
+			ttl = soa.Minttl
+		}
+		if ttls.seen && ttls.min < ttl {
+			ttl = ttls.min
+		}
+		soa.Hdr.Ttl = ttl
+		ns = append(ns, soa)
+	}
+	return ns
+}
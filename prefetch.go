@@ -0,0 +1,61 @@
+package finalize
+
+import (
+	"context"
+	"strings"
+
+	"github.com/coredns/coredns/plugin/metrics"
+	ot "github.com/opentracing/opentracing-go"
+)
+
+const (
+	// defaultPrefetchPercent is the share of the lifetime of a cache entry
+	// left when it is prefetched by default.
+	defaultPrefetchPercent = 10
+
+	// lookupSourceClient and lookupSourcePrefetch tell lookups made for
+	// client queries from those made by prefetches.
+	lookupSourceClient   = "client"
+	lookupSourcePrefetch = "prefetch"
+)
+
+// prefetchKey marks the context of prefetches.
+type prefetchKey struct{}
+
+// prefetch resolves the chain from target anew in the background, so the
+// cache entry of the chain is renewed before it expires. w is the walk which
+// hit the entry and usage the usage of the entry.
+func (s *Finalize) prefetch(ctx context.Context, w *chainWalk, target string, usage *cacheUsage) {
+	defer usage.prefetching.Store(false)
+
+	ctx = context.WithValue(context.WithoutCancel(ctx), prefetchKey{}, true)
+	// The span of the query is finished by the time the prefetch runs.
+	ctx = ot.ContextWithSpan(ctx, nil)
+	if s.deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.deadline)
+		defer cancel()
+	}
+	prefetchCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+
+	pw := &chainWalk{
+		state:       w.state,
+		lookupState: w.lookupState,
+		subnet:      w.subnet,
+		visited:     map[string]struct{}{strings.ToLower(target): {}},
+		refresh:     true,
+	}
+	if w.v != nil {
+		pw.v = s.newValidation(w.lookupState)
+	}
+	res := s.resolveTail(ctx, pw, target, chainTTLs{}, true)
+	log.Debugf("Prefetched CNAME target=%s type=%s outcome=%s", target, w.state.Type(), res.outcome)
+}
+
+// lookupSource returns the source label of lookups made with ctx.
+func lookupSource(ctx context.Context) string {
+	if ctx.Value(prefetchKey{}) != nil {
+		return lookupSourcePrefetch
+	}
+	return lookupSourceClient
+}
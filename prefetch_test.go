@@ -0,0 +1,84 @@
+package finalize
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// countingLookuper answers lookups with an A record with a TTL of 300 and
+// counts them.
+type countingLookuper struct {
+	lookups atomic.Int32
+}
+
+func (l *countingLookuper) Lookup(ctx context.Context, state request.Request, name string, qtype uint16) (*dns.Msg, error) {
+	l.lookups.Add(1)
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.Response = true
+	m.Answer = []dns.RR{mustRR(name + " 300 IN A 203.0.113.10")}
+	return m, nil
+}
+
+func TestFinalizePrefetch(t *testing.T) {
+	upstream := &countingLookuper{}
+	finalize := New()
+	finalize.Next = cnameHandler{}
+	finalize.upstream = upstream
+	finalize.cache = newChainCache(16, defaultCacheMaxTTL)
+	finalize.cache.prefetch = 2
+	finalize.cache.prefetchPercent = 10
+
+	start := time.Now()
+	var elapsed atomic.Int64
+	finalize.cache.now = func() time.Time { return start.Add(time.Duration(elapsed.Load())) }
+
+	query := func(at time.Duration) {
+		t.Helper()
+		elapsed.Store(int64(at))
+		req := new(dns.Msg)
+		req.SetQuestion("foo.example.", dns.TypeA)
+
+		w := newCaptureResponseWriter()
+		if _, err := finalize.ServeDNS(context.Background(), w, req); err != nil {
+			t.Fatalf("finalize ServeDNS failed: %v", err)
+		}
+		if w.msg == nil || !allAnswersType(w.msg.Answer, dns.TypeA) {
+			t.Fatalf("expected flattened A answer, got: %v", w.msg)
+		}
+	}
+
+	query(0)
+	// Enough hits, but too much of the lifetime is left.
+	query(100 * time.Second)
+	query(200 * time.Second)
+	if got := upstream.lookups.Load(); got != 1 {
+		t.Fatalf("expected a single lookup before the prefetch, got %d", got)
+	}
+
+	// 20s of 300s are left, below the prefetch threshold of 10%.
+	query(280 * time.Second)
+	key := cacheKey("bar.example.", dns.TypeA, "")
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		item, ok := finalize.cache.items.Get(key)
+		if upstream.lookups.Load() == 2 && ok && item.added.Equal(start.Add(280*time.Second)) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the chain to be prefetched, got %d lookups", upstream.lookups.Load())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The prefetched entry outlives the original one.
+	query(400 * time.Second)
+	if got := upstream.lookups.Load(); got != 2 {
+		t.Fatalf("expected the prefetched entry to answer the query, got %d lookups", got)
+	}
+}
@@ -0,0 +1,163 @@
+package finalize
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/coredns/coredns/plugin/metrics"
+	pkgparse "github.com/coredns/coredns/plugin/pkg/parse"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultResolverTimeout  = 2 * time.Second
+	defaultResolverMaxFails = 2
+	// resolverDownTime is how long a resolver is skipped after reaching the
+	// maximum number of consecutive failures.
+	resolverDownTime = 10 * time.Second
+)
+
+// lookuper resolves a single hop of a chain. *upstream.Upstream, which routes
+// lookups through the local server, implements it as well.
+type lookuper interface {
+	Lookup(ctx context.Context, state request.Request, name string, typ uint16) (*dns.Msg, error)
+}
+
+// resolver is a single dedicated resolver address and its health.
+type resolver struct {
+	addr  string
+	net   string
+	fails atomic.Uint32
+	// downUntil is the unix time in nanoseconds until which the resolver is
+	// considered unhealthy.
+	downUntil atomic.Int64
+}
+
+func (r *resolver) healthy(now time.Time) bool {
+	return now.UnixNano() >= r.downUntil.Load()
+}
+
+// resolverPool queries dedicated resolvers directly, bypassing the plugin
+// chain of the server. Healthy resolvers are tried in configured order before
+// unhealthy ones.
+type resolverPool struct {
+	resolvers []*resolver
+	timeout   time.Duration
+	maxFails  uint32
+	now       func() time.Time
+}
+
+func newResolverPool(addrs []string) (*resolverPool, error) {
+	p := &resolverPool{
+		timeout:  defaultResolverTimeout,
+		maxFails: defaultResolverMaxFails,
+		now:      time.Now,
+	}
+	for _, addr := range addrs {
+		network, hostPort, err := parseResolverAddr(addr)
+		if err != nil {
+			return nil, err
+		}
+		p.resolvers = append(p.resolvers, &resolver{addr: hostPort, net: network})
+	}
+	if len(p.resolvers) == 0 {
+		return nil, errors.New("no resolver addresses given")
+	}
+	return p, nil
+}
+
+// parseResolverAddr splits a resolver address of the form
+// [udp://|tcp://]IP[:PORT] into its network and host:port.
+func parseResolverAddr(addr string) (string, string, error) {
+	network := "udp"
+	if trans, host, ok := strings.Cut(addr, "://"); ok {
+		switch strings.ToLower(trans) {
+		case "udp", "dns":
+		case "tcp":
+			network = "tcp"
+		default:
+			return "", "", fmt.Errorf("unsupported resolver transport %s", trans)
+		}
+		addr = host
+	}
+	hostPort, err := pkgparse.HostPort(addr, "53")
+	if err != nil {
+		return "", "", err
+	}
+	return network, hostPort, nil
+}
+
+// Lookup implements the lookuper interface. The query is built from the
+// client request, so flags and EDNS0 options are the same as for lookups
+// through the local server. Like the forward plugin, UDP resolvers are
+// queried over TCP if the client is connected over TCP.
+func (p *resolverPool) Lookup(ctx context.Context, state request.Request, name string, typ uint16) (*dns.Msg, error) {
+	req := state.NewWithQuestion(name, typ).Req
+	req.Id = dns.Id()
+	tcp := state.Proto() == "tcp"
+
+	var lastErr error
+	for _, r := range p.ordered() {
+		resp, err := p.exchange(ctx, r, req, tcp)
+		if err == nil {
+			r.fails.Store(0)
+			return resp, nil
+		}
+		lastErr = err
+		resolverFailureCount.WithLabelValues(metrics.WithServer(ctx), r.addr).Inc()
+		if r.fails.Add(1) >= p.maxFails {
+			r.downUntil.Store(p.now().Add(resolverDownTime).UnixNano())
+		}
+		log.Debugf("Lookup of %s via resolver %s failed: %v", name, r.addr, err)
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// ordered returns the healthy resolvers followed by the unhealthy ones.
+func (p *resolverPool) ordered() []*resolver {
+	now := p.now()
+	healthy := make([]*resolver, 0, len(p.resolvers))
+	unhealthy := make([]*resolver, 0, len(p.resolvers))
+	for _, r := range p.resolvers {
+		if r.healthy(now) {
+			healthy = append(healthy, r)
+		} else {
+			unhealthy = append(unhealthy, r)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// exchange sends req to r, over TCP if tcp is set. Truncated UDP responses
+// are retried over TCP. SERVFAIL and REFUSED responses count as failures of
+// the resolver.
+func (p *resolverPool) exchange(ctx context.Context, r *resolver, req *dns.Msg, tcp bool) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	client := &dns.Client{Net: r.net, Timeout: p.timeout}
+	if tcp {
+		client.Net = "tcp"
+	}
+	resp, _, err := client.ExchangeContext(ctx, req, r.addr)
+	if err == nil && resp.Truncated && client.Net == "udp" {
+		client.Net = "tcp"
+		resp, _, err = client.ExchangeContext(ctx, req, r.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused {
+		return nil, fmt.Errorf("resolver %s returned %s", r.addr, dns.RcodeToString[resp.Rcode])
+	}
+	return resp, nil
+}
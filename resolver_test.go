@@ -0,0 +1,99 @@
+package finalize
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/miekg/dns"
+)
+
+func TestResolverPoolFailsOver(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		switch r.Question[0].Name {
+		case "bar.example.":
+			m.Answer = []dns.RR{mustRR("bar.example. 60 IN CNAME baz.example.")}
+		default:
+			m.Answer = []dns.RR{mustRR(r.Question[0].Name + " 60 IN A 203.0.113.10")}
+		}
+		_ = w.WriteMsg(m)
+	})
+	defer s.Close()
+
+	// A closed port makes the first resolver fail right away.
+	closed, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	failing := closed.LocalAddr().String()
+	closed.Close()
+
+	pool, err := newResolverPool([]string{failing, "udp://" + s.Addr})
+	if err != nil {
+		t.Fatalf("failed to create resolver pool: %v", err)
+	}
+	pool.maxFails = 1
+
+	finalize := New()
+	finalize.upstream = pool
+	finalize.Next = cnameHandler{}
+
+	req := new(dns.Msg)
+	req.SetQuestion("foo.example.", dns.TypeA)
+
+	// No server in the context: lookups must not go through the plugin chain.
+	w := newCaptureResponseWriter()
+	if _, err := finalize.ServeDNS(context.Background(), w, req); err != nil {
+		t.Fatalf("finalize ServeDNS failed: %v", err)
+	}
+	if w.msg == nil || !allAnswersType(w.msg.Answer, dns.TypeA) {
+		t.Fatalf("expected flattened A answer, got: %v", w.msg)
+	}
+	if got := w.msg.Answer[0].Header().Name; got != "foo.example." {
+		t.Fatalf("expected answer name to be foo.example., got %q", got)
+	}
+
+	if pool.resolvers[0].healthy(time.Now()) {
+		t.Fatal("expected failing resolver to be marked unhealthy")
+	}
+	if ordered := pool.ordered(); ordered[0].addr != s.Addr {
+		t.Fatalf("expected healthy resolver %s to be tried first, got %s", s.Addr, ordered[0].addr)
+	}
+}
+
+func TestParseResolverAddr(t *testing.T) {
+	tests := []struct {
+		addr     string
+		network  string
+		hostPort string
+		err      bool
+	}{
+		{addr: "10.0.0.1", network: "udp", hostPort: "10.0.0.1:53"},
+		{addr: "tcp://10.0.0.1:5353", network: "tcp", hostPort: "10.0.0.1:5353"},
+		{addr: "udp://[::1]:53", network: "udp", hostPort: "[::1]:53"},
+		{addr: "tls://10.0.0.1", err: true},
+		{addr: "resolver.example", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			network, hostPort, err := parseResolverAddr(tt.addr)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected error for %s", tt.addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if network != tt.network || hostPort != tt.hostPort {
+				t.Errorf("expected %s %s, got %s %s", tt.network, tt.hostPort, network, hostPort)
+			}
+		})
+	}
+}
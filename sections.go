@@ -0,0 +1,106 @@
+package finalize
+
+import (
+	"strings"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+const (
+	// sectionsKeep keeps the authority and additional sections of the
+	// original answer.
+	sectionsKeep = "keep"
+	// sectionsDrop drops the records of the chain zones from the authority
+	// and additional sections.
+	sectionsDrop = "drop"
+	// sectionsReplace replaces the authority and additional sections with
+	// the ones of the answer the terminal records were taken from.
+	sectionsReplace = "replace"
+)
+
+// rewriteSections rewrites the authority and additional sections of the
+// flattened response r according to the section policy. The OPT record of r
+// is always kept and signatures which no longer cover a record of their
+// section are removed. A SOA left over from a negative original answer is
+// dropped whatever the policy.
+func (s *Finalize) rewriteSections(state request.Request, r *dns.Msg, res result) {
+	r.Ns = withoutSOA(r.Ns)
+
+	policy := s.sections
+	if policy == sectionsReplace && res.terminal == nil {
+		// The terminal records of cached chains come without sections.
+		policy = sectionsDrop
+	}
+
+	switch policy {
+	case sectionsDrop:
+		r.Ns = ownedRecords(r.Ns, state.QName(), nil)
+		r.Extra = ownedRecords(r.Extra, state.QName(), r.Ns)
+	case sectionsReplace:
+		if res.terminal != r {
+			opt := r.IsEdns0()
+			r.Ns = copyRecords(res.terminal.Ns, state.Do())
+			r.Extra = copyRecords(res.terminal.Extra, state.Do())
+			if opt != nil {
+				r.Extra = append(r.Extra, opt)
+			}
+		}
+	}
+
+	r.Ns = stripOrphanSignatures(r.Ns)
+	r.Extra = stripOrphanSignatures(r.Extra)
+}
+
+// withoutSOA returns the records of rrs which aren't SOA records.
+func withoutSOA(rrs []dns.RR) []dns.RR {
+	kept := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		if rr.Header().Rrtype != dns.TypeSOA {
+			kept = append(kept, rr)
+		}
+	}
+	return kept
+}
+
+// ownedRecords returns the records of rrs which belong to the zones of qname,
+// i.e. whose owner is qname or one of its ancestors, the glue of the NS
+// records in ns and the OPT record.
+func ownedRecords(rrs []dns.RR, qname string, ns []dns.RR) []dns.RR {
+	glue := map[string]struct{}{}
+	for _, rr := range ns {
+		if n, ok := rr.(*dns.NS); ok {
+			glue[strings.ToLower(n.Ns)] = struct{}{}
+		}
+	}
+
+	owned := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeOPT || dns.IsSubDomain(rr.Header().Name, qname) {
+			owned = append(owned, rr)
+			continue
+		}
+		if _, ok := glue[strings.ToLower(rr.Header().Name)]; ok {
+			owned = append(owned, rr)
+		}
+	}
+	return owned
+}
+
+// copyRecords copies rrs without the OPT record. DNSSEC records are only
+// copied if do is set.
+func copyRecords(rrs []dns.RR, do bool) []dns.RR {
+	copied := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		switch rr.Header().Rrtype {
+		case dns.TypeOPT:
+			continue
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+			if !do {
+				continue
+			}
+		}
+		copied = append(copied, dns.Copy(rr))
+	}
+	return copied
+}
@@ -0,0 +1,173 @@
+package finalize
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
+)
+
+// delegatedCnameHandler answers www.example.com. with a CNAME into
+// example.net. and the delegations of both zones.
+type delegatedCnameHandler struct{}
+
+func (h delegatedCnameHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Answer = []dns.RR{mustRR("www.example.com. 60 IN CNAME cdn.example.net.")}
+	m.Ns = []dns.RR{
+		mustRR("example.net. 3600 IN NS ns1.example.net."),
+		mustRR("example.com. 3600 IN NS ns1.example.com."),
+	}
+	m.Extra = []dns.RR{
+		mustRR("ns1.example.net. 3600 IN A 192.0.2.1"),
+		mustRR("ns1.example.com. 3600 IN A 192.0.2.2"),
+	}
+	m.SetEdns0(4096, false)
+
+	_ = w.WriteMsg(m)
+	return dns.RcodeSuccess, nil
+}
+
+func (h delegatedCnameHandler) Name() string { return "delegatedCname" }
+
+// delegatedHandler answers the lookups with an A record and the delegation
+// of example.net.
+type delegatedHandler struct{}
+
+func (h delegatedHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Answer = []dns.RR{mustRR(r.Question[0].Name + " 60 IN A 203.0.113.10")}
+	m.Ns = []dns.RR{mustRR("example.net. 3600 IN NS ns2.example.net.")}
+	m.Extra = []dns.RR{mustRR("ns2.example.net. 3600 IN A 192.0.2.3")}
+
+	_ = w.WriteMsg(m)
+	return dns.RcodeSuccess, nil
+}
+
+func (h delegatedHandler) Name() string { return "delegated" }
+
+func TestFinalizeRewritesSections(t *testing.T) {
+	cfg := &dnsserver.Config{
+		Zone:        ".",
+		ListenHosts: []string{""},
+		Port:        "53",
+		Plugin: []plugin.Plugin{
+			func(next plugin.Handler) plugin.Handler {
+				return delegatedHandler{}
+			},
+		},
+	}
+	server, err := dnsserver.NewServer("dns://:53", []*dnsserver.Config{cfg})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	ctx := context.WithValue(context.Background(), dnsserver.Key{}, server)
+	ctx = context.WithValue(ctx, dnsserver.LoopKey{}, 0)
+
+	tests := []struct {
+		policy string
+		ns     []string
+		extra  []string
+	}{
+		{
+			policy: sectionsKeep,
+			ns:     []string{"example.net.", "example.com."},
+			extra:  []string{"ns1.example.net.", "ns1.example.com.", "."},
+		},
+		{
+			policy: sectionsDrop,
+			ns:     []string{"example.com."},
+			extra:  []string{"ns1.example.com.", "."},
+		},
+		{
+			policy: sectionsReplace,
+			ns:     []string{"example.net."},
+			extra:  []string{"ns2.example.net.", "."},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.policy, func(t *testing.T) {
+			finalize := New()
+			finalize.Next = delegatedCnameHandler{}
+			finalize.sections = tc.policy
+
+			req := new(dns.Msg)
+			req.SetQuestion("www.example.com.", dns.TypeA)
+			req.SetEdns0(4096, false)
+
+			w := newCaptureResponseWriter()
+			if _, err := finalize.ServeDNS(ctx, w, req); err != nil {
+				t.Fatalf("finalize ServeDNS failed: %v", err)
+			}
+			if w.msg == nil || !allAnswersType(w.msg.Answer, dns.TypeA) {
+				t.Fatalf("expected a flattened answer, got: %v", w.msg)
+			}
+			assertOwners(t, "authority", w.msg.Ns, tc.ns)
+			assertOwners(t, "additional", w.msg.Extra, tc.extra)
+			if w.msg.IsEdns0() == nil {
+				t.Fatal("expected the OPT record to be kept")
+			}
+		})
+	}
+}
+
+// nxdomainCnameHandler answers www.example.com. with a CNAME into
+// example.net. and NXDOMAIN for the target, as if the target didn't exist.
+type nxdomainCnameHandler struct{}
+
+func (h nxdomainCnameHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeNameError)
+	m.Answer = []dns.RR{mustRR("www.example.com. 60 IN CNAME cdn.example.net.")}
+	m.Ns = []dns.RR{
+		mustRR("example.net. 300 IN SOA ns1.example.net. hostmaster.example.net. 1 7200 3600 1209600 300"),
+		mustRR("example.com. 3600 IN NS ns1.example.com."),
+	}
+
+	_ = w.WriteMsg(m)
+	return dns.RcodeNameError, nil
+}
+
+func (h nxdomainCnameHandler) Name() string { return "nxdomainCname" }
+
+func TestFinalizeFlattensNegativeOriginal(t *testing.T) {
+	for _, policy := range []string{sectionsKeep, sectionsDrop} {
+		t.Run(policy, func(t *testing.T) {
+			finalize := New()
+			finalize.Next = nxdomainCnameHandler{}
+			finalize.upstream = &countingLookuper{}
+			finalize.sections = policy
+
+			req := new(dns.Msg)
+			req.SetQuestion("www.example.com.", dns.TypeA)
+
+			w := newCaptureResponseWriter()
+			if _, err := finalize.ServeDNS(context.Background(), w, req); err != nil {
+				t.Fatalf("finalize ServeDNS failed: %v", err)
+			}
+			if w.msg == nil || !allAnswersType(w.msg.Answer, dns.TypeA) {
+				t.Fatalf("expected a flattened answer, got: %v", w.msg)
+			}
+			if w.msg.Rcode != dns.RcodeSuccess {
+				t.Fatalf("expected rcode NOERROR, got %s", dns.RcodeToString[w.msg.Rcode])
+			}
+			assertOwners(t, "authority", w.msg.Ns, []string{"example.com."})
+		})
+	}
+}
+
+func assertOwners(t *testing.T, section string, rrs []dns.RR, owners []string) {
+	t.Helper()
+	if len(rrs) != len(owners) {
+		t.Fatalf("expected %s section owned by %v, got: %v", section, owners, rrs)
+	}
+	for i, rr := range rrs {
+		if rr.Header().Name != owners[i] {
+			t.Fatalf("expected %s section owned by %v, got: %v", section, owners, rrs)
+		}
+	}
+}
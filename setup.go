@@ -2,12 +2,16 @@ package finalize
 
 import (
 	"fmt"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/durations"
+	"github.com/miekg/dns"
 )
 
 // init registers this plugin.
@@ -30,38 +34,543 @@ func setup(c *caddy.Controller) error {
 	return nil
 }
 
+// settings are the keywords which can follow the zones of the directive or
+// start a line in its block.
+var settings = map[string]struct{}{
+	"force_resolve":      {},
+	"max_depth":          {},
+	"types":              {},
+	"resolvers":          {},
+	"resolver_timeout":   {},
+	"resolver_max_fails": {},
+	"cache_size":         {},
+	"cache_max_ttl":      {},
+	"except":             {},
+	"on_failure":         {},
+	"ttl":                {},
+	"dnssec_policy":      {},
+	"dnssec_validate":    {},
+	"ecs":                {},
+	"sections":           {},
+	"timeout":            {},
+	"deadline":           {},
+	"retries":            {},
+	"tcp_fallback":       {},
+	"serve_stale":        {},
+	"prefetch":           {},
+	"debug":              {},
+}
+
+func isSetting(arg string) bool {
+	_, ok := settings[strings.ToLower(arg)]
+	return ok
+}
+
+// isZone reports whether arg looks like a zone, a domain name with at least
+// one dot or the root. This keeps a mistyped setting from being taken as a
+// zone.
+func isZone(arg string) bool {
+	return strings.Contains(arg, ".")
+}
+
+// options collects the settings which are applied once the whole directive
+// has been parsed.
+type options struct {
+	cacheSize        int
+	cacheMaxTTL      time.Duration
+	resolvers        []string
+	resolverTimeout  time.Duration
+	resolverMaxFails int
+	serveStale       bool
+	staleMaxAge      time.Duration
+	staleTTL         uint32
+	prefetch         int
+	prefetchPercent  int
+}
+
+// parse reads the directive in its inline form
+//
+//	finalize [ZONES...] [SETTING [ARGS...]]...
+//
+// or its block form, where each setting is on a line of its own
+//
+//	finalize [ZONES...] {
+//	    SETTING [ARGS...]
+//	}
+//
+// Both forms can be combined, but each setting may only be given once. The
+// only exception is on_failure, which may be repeated for distinct failure
+// classes.
 func parse(c *caddy.Controller) (*Finalize, error) {
 	finalizePlugin := New()
+	opts := options{
+		cacheMaxTTL:      defaultCacheMaxTTL,
+		resolverTimeout:  defaultResolverTimeout,
+		resolverMaxFails: defaultResolverMaxFails,
+		staleMaxAge:      defaultStaleMaxAge,
+		staleTTL:         defaultStaleTTL,
+		prefetchPercent:  defaultPrefetchPercent,
+	}
+	seen := map[string]struct{}{}
 	for c.Next() {
 		args := c.RemainingArgs()
-		if len(args) == 0 {
-			continue
-		}
-		for i := 0; i < len(args); {
-			switch strings.ToLower(args[i]) {
-			case "force_resolve":
-				finalizePlugin.forceResolve = true
-				i++
-			case "max_depth":
-				if i+1 >= len(args) {
-					return nil, c.ArgErr()
-				}
-				n, err := strconv.Atoi(args[i+1])
-				if err != nil {
-					return nil, err
-				}
-				if n <= 0 {
-					return nil, fmt.Errorf("max_depth parameter must be greater than 0")
-				}
-				finalizePlugin.maxDepth = n
-				i += 2
-			default:
-				return nil, fmt.Errorf("unsupported parameter %s for finalize setting", args[i])
+		// Leading arguments which aren't settings are the zones to finalize.
+		zones := []string{}
+		for len(args) > 0 && !isSetting(args[0]) {
+			if !isZone(args[0]) {
+				return nil, fmt.Errorf("unsupported parameter %s for finalize setting", args[0])
+			}
+			zones = append(zones, args[0])
+			args = args[1:]
+		}
+		if origins := plugin.OriginsFromArgsOrServerBlock(zones, c.ServerBlockKeys); len(origins) > 0 {
+			finalizePlugin.zones = origins
+		}
+
+		// Inline settings take all following arguments up to the next setting.
+		for len(args) > 0 {
+			n := 1
+			for n < len(args) && !isSetting(args[n]) {
+				n++
+			}
+			if err := parseSetting(c, finalizePlugin, &opts, seen, args[0], args[1:n]); err != nil {
+				return nil, err
+			}
+			args = args[n:]
+		}
+
+		for c.NextBlock() {
+			if !isSetting(c.Val()) {
+				return nil, c.Errf("unknown property '%s'", c.Val())
+			}
+			if err := parseSetting(c, finalizePlugin, &opts, seen, c.Val(), c.RemainingArgs()); err != nil {
+				return nil, err
 			}
 		}
 	}
 
+	if len(opts.resolvers) > 0 {
+		pool, err := newResolverPool(opts.resolvers)
+		if err != nil {
+			return nil, err
+		}
+		pool.timeout = opts.resolverTimeout
+		pool.maxFails = uint32(opts.resolverMaxFails)
+		finalizePlugin.upstream = pool
+	}
+
+	if opts.cacheSize > 0 {
+		finalizePlugin.cache = newChainCache(opts.cacheSize, opts.cacheMaxTTL)
+	}
+	if opts.serveStale {
+		if finalizePlugin.cache == nil {
+			return nil, fmt.Errorf("serve_stale requires cache_size")
+		}
+		finalizePlugin.cache.stale = opts.staleMaxAge
+		finalizePlugin.staleTTL = opts.staleTTL
+	}
+	if opts.prefetch > 0 {
+		if finalizePlugin.cache == nil {
+			return nil, fmt.Errorf("prefetch requires cache_size")
+		}
+		finalizePlugin.cache.prefetch = uint32(opts.prefetch)
+		finalizePlugin.cache.prefetchPercent = opts.prefetchPercent
+	}
+
 	log.Debug("Successfully parsed configuration")
 
 	return finalizePlugin, nil
 }
+
+// parseSetting applies the setting name with its arguments args.
+func parseSetting(c *caddy.Controller, f *Finalize, opts *options, seen map[string]struct{}, name string, args []string) error {
+	name = strings.ToLower(name)
+	if name != "on_failure" {
+		if _, ok := seen[name]; ok {
+			return fmt.Errorf("duplicate setting %s for finalize", name)
+		}
+		seen[name] = struct{}{}
+	}
+
+	switch name {
+	case "force_resolve":
+		if len(args) != 0 {
+			return c.ArgErr()
+		}
+		f.forceResolve = true
+	case "max_depth":
+		n, err := parsePositiveInt(c, name, args)
+		if err != nil {
+			return err
+		}
+		f.maxDepth = n
+	case "types":
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		types := map[uint16]struct{}{}
+		for _, arg := range args {
+			qtype, ok := dns.StringToType[strings.ToUpper(arg)]
+			if !ok {
+				return fmt.Errorf("unknown type %s for types setting", arg)
+			}
+			switch qtype {
+			case dns.TypeCNAME, dns.TypeDNAME, dns.TypeANY, dns.TypeOPT, dns.TypeAXFR, dns.TypeIXFR:
+				return fmt.Errorf("type %s can't be flattened", arg)
+			}
+			types[qtype] = struct{}{}
+		}
+		f.types = types
+	case "resolvers":
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		for _, arg := range args {
+			if _, _, err := parseResolverAddr(arg); err != nil {
+				return err
+			}
+		}
+		opts.resolvers = args
+	case "resolver_timeout":
+		d, err := parseDuration(c, name, args)
+		if err != nil {
+			return err
+		}
+		opts.resolverTimeout = d
+	case "resolver_max_fails":
+		n, err := parsePositiveInt(c, name, args)
+		if err != nil {
+			return err
+		}
+		opts.resolverMaxFails = n
+	case "cache_size":
+		n, err := parsePositiveInt(c, name, args)
+		if err != nil {
+			return err
+		}
+		opts.cacheSize = n
+	case "cache_max_ttl":
+		d, err := parseDuration(c, name, args)
+		if err != nil {
+			return err
+		}
+		if d < time.Second {
+			return fmt.Errorf("cache_max_ttl parameter must be at least 1s")
+		}
+		opts.cacheMaxTTL = d
+	case "except":
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		for _, arg := range args {
+			f.except = append(f.except, plugin.Host(arg).NormalizeExact()...)
+		}
+	case "on_failure":
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		rcode, ok := failureActions[strings.ToLower(args[0])]
+		if !ok {
+			return fmt.Errorf("unknown action %s for on_failure setting", args[0])
+		}
+		classes := args[1:]
+		switch {
+		case rcode == failureNegative && len(classes) == 0:
+			// Only dangling chains end in a negative answer.
+			classes = []string{string(outcomeDangling)}
+		case len(classes) == 0:
+			// Without classes the action applies to all failures.
+			for class := range failureClasses {
+				classes = append(classes, class)
+			}
+		}
+		for _, class := range classes {
+			o, ok := failureClasses[strings.ToLower(class)]
+			if !ok {
+				return fmt.Errorf("unknown failure class %s for on_failure setting", class)
+			}
+			if rcode == failureNegative && o != outcomeDangling {
+				return fmt.Errorf("on_failure negative only applies to the %s failure class", outcomeDangling)
+			}
+			key := name + "/" + string(o)
+			if _, ok := seen[key]; ok {
+				return fmt.Errorf("duplicate on_failure action for failure class %s", o)
+			}
+			seen[key] = struct{}{}
+			f.onFailure[o] = rcode
+		}
+	case "ttl":
+		policy, err := parseTTLPolicy(c, args)
+		if err != nil {
+			return err
+		}
+		f.ttl = policy
+	case "dnssec_policy":
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		switch policy := strings.ToLower(args[0]); policy {
+		case dnssecFlatten, dnssecRefuse:
+			f.dnssecPolicy = policy
+		default:
+			return fmt.Errorf("unknown dnssec_policy %s", args[0])
+		}
+	case "dnssec_validate":
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		file := args[0]
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(dnsserver.GetConfig(c).Root, file)
+		}
+		anchors, err := readTrustAnchors(file)
+		if err != nil {
+			return err
+		}
+		f.anchors = anchors
+	case "ecs":
+		policy, err := parseECSPolicy(c, args)
+		if err != nil {
+			return err
+		}
+		f.ecs = policy
+	case "sections":
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		switch policy := strings.ToLower(args[0]); policy {
+		case sectionsKeep, sectionsDrop, sectionsReplace:
+			f.sections = policy
+		default:
+			return fmt.Errorf("unknown sections policy %s", args[0])
+		}
+	case "timeout":
+		d, err := parseDuration(c, name, args)
+		if err != nil {
+			return err
+		}
+		f.timeout = d
+	case "deadline":
+		d, err := parseDuration(c, name, args)
+		if err != nil {
+			return err
+		}
+		f.deadline = d
+	case "retries":
+		if len(args) == 0 || len(args) > 2 {
+			return c.ArgErr()
+		}
+		n, err := parsePositiveInt(c, name, args[:1])
+		if err != nil {
+			return err
+		}
+		f.retries = n
+		if len(args) == 2 {
+			d, err := parseDuration(c, "retries backoff", args[1:])
+			if err != nil {
+				return err
+			}
+			f.retryBackoff = d
+		}
+	case "serve_stale":
+		if len(args) > 2 {
+			return c.ArgErr()
+		}
+		opts.serveStale = true
+		if len(args) > 0 {
+			d, err := parseDuration(c, name, args[:1])
+			if err != nil {
+				return err
+			}
+			opts.staleMaxAge = d
+		}
+		if len(args) > 1 {
+			ttl, err := parseTTL(args[1])
+			if err != nil {
+				return err
+			}
+			if ttl == 0 {
+				return fmt.Errorf("serve_stale ttl must be greater than 0")
+			}
+			opts.staleTTL = ttl
+		}
+	case "prefetch":
+		if len(args) == 0 || len(args) > 2 {
+			return c.ArgErr()
+		}
+		n, err := parsePositiveInt(c, name, args[:1])
+		if err != nil {
+			return err
+		}
+		opts.prefetch = n
+		if len(args) == 2 {
+			pct, err := strconv.Atoi(strings.TrimSuffix(args[1], "%"))
+			if err != nil {
+				return fmt.Errorf("invalid prefetch percentage %s: %w", args[1], err)
+			}
+			if pct < 1 || pct > 100 {
+				return fmt.Errorf("prefetch percentage must be between 1%% and 100%%")
+			}
+			opts.prefetchPercent = pct
+		}
+	case "debug":
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		code, err := strconv.ParseUint(args[0], 0, 16)
+		if err != nil {
+			return fmt.Errorf("invalid debug option code %s: %w", args[0], err)
+		}
+		networks := args[1:]
+		if len(networks) == 0 {
+			networks = defaultDebugNetworks
+		}
+		p, err := newDebugPolicy(uint16(code), networks)
+		if err != nil {
+			return err
+		}
+		f.debug = p
+	case "tcp_fallback":
+		if len(args) != 0 {
+			return c.ArgErr()
+		}
+		f.tcpFallback = true
+	default:
+		return fmt.Errorf("unsupported parameter %s for finalize setting", name)
+	}
+	return nil
+}
+
+// parseTTLPolicy parses the arguments of the ttl setting
+//
+//	ttl min|max|first|last|fixed N [floor N] [ceiling N]
+func parseTTLPolicy(c *caddy.Controller, args []string) (ttlPolicy, error) {
+	if len(args) == 0 {
+		return ttlPolicy{}, c.ArgErr()
+	}
+	policy := ttlPolicy{mode: strings.ToLower(args[0])}
+	args = args[1:]
+	switch policy.mode {
+	case ttlMin, ttlMax, ttlFirst, ttlLast:
+	case ttlFixed:
+		if len(args) == 0 {
+			return ttlPolicy{}, c.ArgErr()
+		}
+		ttl, err := parseTTL(args[0])
+		if err != nil {
+			return ttlPolicy{}, err
+		}
+		policy.fixed = ttl
+		args = args[1:]
+	default:
+		return ttlPolicy{}, fmt.Errorf("unknown ttl policy %s", policy.mode)
+	}
+
+	seen := map[string]struct{}{}
+	for len(args) > 0 {
+		clamp := strings.ToLower(args[0])
+		if clamp != "floor" && clamp != "ceiling" {
+			return ttlPolicy{}, fmt.Errorf("unknown ttl option %s", args[0])
+		}
+		if _, ok := seen[clamp]; ok {
+			return ttlPolicy{}, fmt.Errorf("duplicate ttl option %s", clamp)
+		}
+		seen[clamp] = struct{}{}
+		if len(args) < 2 {
+			return ttlPolicy{}, c.ArgErr()
+		}
+		ttl, err := parseTTL(args[1])
+		if err != nil {
+			return ttlPolicy{}, err
+		}
+		if clamp == "floor" {
+			policy.floor = ttl
+		} else {
+			if ttl == 0 {
+				return ttlPolicy{}, fmt.Errorf("ttl ceiling must be greater than 0")
+			}
+			policy.ceiling = ttl
+		}
+		args = args[2:]
+	}
+	if policy.ceiling > 0 && policy.floor > policy.ceiling {
+		return ttlPolicy{}, fmt.Errorf("ttl floor %d is greater than ceiling %d", policy.floor, policy.ceiling)
+	}
+	return policy, nil
+}
+
+// parseECSPolicy parses the arguments of the ecs setting
+//
+//	ecs strip|forward|synthesize [IPV4_PREFIX [IPV6_PREFIX]]
+func parseECSPolicy(c *caddy.Controller, args []string) (*ecsPolicy, error) {
+	if len(args) == 0 || len(args) > 3 {
+		return nil, c.ArgErr()
+	}
+	policy := &ecsPolicy{mode: strings.ToLower(args[0]), prefixV4: defaultECSPrefixV4, prefixV6: defaultECSPrefixV6}
+	switch policy.mode {
+	case ecsStrip:
+		if len(args) > 1 {
+			return nil, c.ArgErr()
+		}
+	case ecsForward, ecsSynthesize:
+	default:
+		return nil, fmt.Errorf("unknown ecs mode %s", args[0])
+	}
+
+	if len(args) > 1 {
+		prefix, err := strconv.ParseUint(args[1], 10, 8)
+		if err != nil || prefix > 32 {
+			return nil, fmt.Errorf("invalid IPv4 prefix length %s for ecs", args[1])
+		}
+		policy.prefixV4 = uint8(prefix)
+	}
+	if len(args) > 2 {
+		prefix, err := strconv.ParseUint(args[2], 10, 8)
+		if err != nil || prefix > 128 {
+			return nil, fmt.Errorf("invalid IPv6 prefix length %s for ecs", args[2])
+		}
+		policy.prefixV6 = uint8(prefix)
+	}
+	return policy, nil
+}
+
+// parseTTL parses a TTL in seconds.
+func parseTTL(arg string) (uint32, error) {
+	ttl, err := strconv.ParseUint(arg, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ttl %s: %w", arg, err)
+	}
+	return uint32(ttl), nil
+}
+
+// parsePositiveInt parses the single argument of setting name as an integer
+// greater than 0.
+func parsePositiveInt(c *caddy.Controller, name string, args []string) (int, error) {
+	if len(args) != 1 {
+		return 0, c.ArgErr()
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil {
+		return 0, err
+	}
+	if n <= 0 {
+		return 0, fmt.Errorf("%s parameter must be greater than 0", name)
+	}
+	return n, nil
+}
+
+// parseDuration parses the single argument of setting name as a duration
+// greater than 0. Plain numbers are interpreted as seconds.
+func parseDuration(c *caddy.Controller, name string, args []string) (time.Duration, error) {
+	if len(args) != 1 {
+		return 0, c.ArgErr()
+	}
+	d, err := durations.NewDurationFromArg(args[0])
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("%s parameter must be greater than 0", name)
+	}
+	return d, nil
+}
@@ -4,9 +4,12 @@
 package finalize
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/coredns/caddy"
+	"github.com/miekg/dns"
 )
 
 // TestSetup tests the various things that should be parsed by setup.
@@ -56,4 +59,512 @@ func TestSetup(t *testing.T) {
 	if err := setup(c); err == nil {
 		t.Fatalf("Expected errors, but got: %v", err)
 	}
+
+	c = caddy.NewTestController("dns", `finalize types A AAAA txt mx max_depth 2`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize types`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize types CNAME`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize types foo`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize resolvers 10.0.0.1 tcp://10.0.0.2:5353 resolver_timeout 500ms resolver_max_fails 3`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize resolvers`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize resolvers resolver.example`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize resolvers 10.0.0.1 resolver_timeout 0`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize cache_size 1000 cache_max_ttl 300`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize cache_size 1000 cache_max_ttl 5m`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize cache_size 0`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize cache_size`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize cache_size 10 cache_max_ttl x`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize dnssec_policy refuse`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize dnssec_policy`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize dnssec_policy validate`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize sections replace`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize sections`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize sections rewrite`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize timeout 500ms deadline 2s`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize timeout 0`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize deadline`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize retries 2 50ms tcp_fallback`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize retries 0`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize retries 2 fast`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize tcp_fallback yes`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize cache_size 100 serve_stale 24h 30`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize cache_size 100 serve_stale`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize serve_stale 1h`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize cache_size 100 serve_stale 1h 0`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize cache_size 100 prefetch 10 20%`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize prefetch 10`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize cache_size 100 prefetch 10 0%`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize cache_size 100 prefetch 10 half`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize debug 65001`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize debug 65001 10.0.0.0/8 2001:db8::/32 192.0.2.1`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize debug`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize debug 8`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize debug 65001 10.0.0.0/33`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize example.org cdn.example max_depth 2 {
+		except static.example.org
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize example.org {
+		except
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize {
+		unknown
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+}
+
+func TestParseZones(t *testing.T) {
+	c := caddy.NewTestController("dns", `finalize Example.org cdn.example force_resolve {
+		except static.example.org
+	}`)
+	f, err := parse(c)
+	if err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if len(f.zones) != 2 || f.zones[0] != "example.org." || f.zones[1] != "cdn.example." {
+		t.Fatalf("Expected zones [example.org. cdn.example.], got %v", f.zones)
+	}
+	if len(f.except) != 1 || f.except[0] != "static.example.org." {
+		t.Fatalf("Expected except [static.example.org.], got %v", f.except)
+	}
+	if !f.forceResolve {
+		t.Fatal("Expected force_resolve to be set")
+	}
+
+	c = caddy.NewTestController("dns", `finalize`)
+	c.ServerBlockKeys = []string{"example.net:53"}
+	f, err = parse(c)
+	if err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if len(f.zones) != 1 || f.zones[0] != "example.net." {
+		t.Fatalf("Expected zones of the server block, got %v", f.zones)
+	}
+
+	// A mistyped setting isn't taken as a zone.
+	c = caddy.NewTestController("dns", `finalize force_reslove`)
+	if _, err := parse(c); err == nil {
+		t.Fatal("Expected errors for a mistyped setting, but got none")
+	}
+	c = caddy.NewTestController("dns", `finalize example.org force_reslove`)
+	if _, err := parse(c); err == nil {
+		t.Fatal("Expected errors for a mistyped setting after a zone, but got none")
+	}
+
+	c = caddy.NewTestController("dns", `finalize . force_resolve`)
+	f, err = parse(c)
+	if err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if len(f.zones) != 1 || f.zones[0] != "." {
+		t.Fatalf("Expected the root zone, got %v", f.zones)
+	}
+}
+
+func TestSetupBlock(t *testing.T) {
+	c := caddy.NewTestController("dns", `finalize example.org {
+		force_resolve
+		max_depth 3
+		types A AAAA TXT
+		resolvers 10.0.0.1 tcp://10.0.0.2
+		resolver_timeout 1s
+		cache_size 100
+		except static.example.org
+	}`)
+	f, err := parse(c)
+	if err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if !f.forceResolve || f.maxDepth != 3 || len(f.types) != 3 || f.cache == nil || len(f.except) != 1 {
+		t.Fatalf("Expected block settings to be applied, got %+v", f)
+	}
+	if _, ok := f.upstream.(*resolverPool); !ok {
+		t.Fatalf("Expected dedicated resolvers, got %T", f.upstream)
+	}
+
+	c = caddy.NewTestController("dns", `finalize max_depth 2 {
+		cache_size 100
+	}`)
+	f, err = parse(c)
+	if err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if f.maxDepth != 2 || f.cache == nil {
+		t.Fatalf("Expected inline and block settings to be applied, got %+v", f)
+	}
+
+	c = caddy.NewTestController("dns", `finalize {
+		max_depth 2
+		max_depth 3
+	}`)
+	if _, err := parse(c); err == nil {
+		t.Fatalf("Expected duplicate setting error, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize max_depth 2 {
+		max_depth 3
+	}`)
+	if _, err := parse(c); err == nil {
+		t.Fatalf("Expected duplicate setting error, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize {
+		max_depth 1 2
+	}`)
+	if _, err := parse(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize {
+		force_resolve yes
+	}`)
+	if _, err := parse(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `finalize {
+		maxdepth 2
+	}`)
+	if _, err := parse(c); err == nil {
+		t.Fatalf("Expected unknown property error, but got: %v", err)
+	}
+}
+
+func TestSetupOnFailure(t *testing.T) {
+	c := caddy.NewTestController("dns", `finalize {
+		on_failure servfail dangling max_depth
+		on_failure nxdomain circular
+	}`)
+	f, err := parse(c)
+	if err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	expected := map[outcome]int{
+		outcomeDangling: dns.RcodeServerFailure,
+		outcomeMaxDepth: dns.RcodeServerFailure,
+		outcomeCircular: dns.RcodeNameError,
+	}
+	if len(f.onFailure) != len(expected) {
+		t.Fatalf("Expected on_failure %v, got %v", expected, f.onFailure)
+	}
+	for o, rcode := range expected {
+		if f.onFailure[o] != rcode {
+			t.Fatalf("Expected on_failure %v, got %v", expected, f.onFailure)
+		}
+	}
+
+	c = caddy.NewTestController("dns", `finalize on_failure refused`)
+	f, err = parse(c)
+	if err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if len(f.onFailure) != len(failureClasses) {
+		t.Fatalf("Expected refused for all failure classes, got %v", f.onFailure)
+	}
+
+	c = caddy.NewTestController("dns", `finalize on_failure negative on_failure servfail circular`)
+	f, err = parse(c)
+	if err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if len(f.onFailure) != 2 || f.onFailure[outcomeDangling] != failureNegative {
+		t.Fatalf("Expected negative answers for dangling chains, got %v", f.onFailure)
+	}
+
+	for _, cfg := range []string{
+		`finalize on_failure`,
+		`finalize on_failure negative circular`,
+		`finalize on_failure drop`,
+		`finalize on_failure servfail unknown`,
+		`finalize {
+			on_failure servfail dangling
+			on_failure refused dangling
+		}`,
+		`finalize {
+			on_failure servfail
+			on_failure original circular
+		}`,
+	} {
+		c = caddy.NewTestController("dns", cfg)
+		if _, err := parse(c); err == nil {
+			t.Fatalf("Expected errors for %q, but got: %v", cfg, err)
+		}
+	}
+}
+
+func TestSetupTTL(t *testing.T) {
+	c := caddy.NewTestController("dns", `finalize ttl last floor 30 ceiling 3600`)
+	f, err := parse(c)
+	if err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if f.ttl != (ttlPolicy{mode: ttlLast, floor: 30, ceiling: 3600}) {
+		t.Fatalf("Expected ttl policy last with clamps, got %+v", f.ttl)
+	}
+
+	c = caddy.NewTestController("dns", `finalize {
+		ttl fixed 0
+	}`)
+	f, err = parse(c)
+	if err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if f.ttl != (ttlPolicy{mode: ttlFixed}) {
+		t.Fatalf("Expected ttl policy fixed 0, got %+v", f.ttl)
+	}
+
+	c = caddy.NewTestController("dns", `finalize`)
+	f, err = parse(c)
+	if err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if f.ttl != defaultTTLPolicy {
+		t.Fatalf("Expected default ttl policy, got %+v", f.ttl)
+	}
+
+	for _, cfg := range []string{
+		`finalize ttl`,
+		`finalize ttl average`,
+		`finalize ttl fixed`,
+		`finalize ttl fixed -1`,
+		`finalize ttl min floor`,
+		`finalize ttl min floor x`,
+		`finalize ttl min ceiling 0`,
+		`finalize ttl min floor 60 ceiling 30`,
+		`finalize ttl min floor 30 floor 60`,
+		`finalize ttl min cap 60`,
+	} {
+		c = caddy.NewTestController("dns", cfg)
+		if _, err := parse(c); err == nil {
+			t.Fatalf("Expected errors for %q, but got: %v", cfg, err)
+		}
+	}
+}
+
+func TestSetupDNSSECValidate(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "anchors")
+	anchor := ". 3600 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D\n"
+	if err := os.WriteFile(file, []byte(anchor), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := caddy.NewTestController("dns", `finalize {
+		dnssec_validate `+file+`
+	}`)
+	f, err := parse(c)
+	if err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if len(f.anchors["."]) != 1 {
+		t.Fatalf("Expected the root trust anchor, got %v", f.anchors)
+	}
+
+	for _, cfg := range []string{
+		`finalize dnssec_validate`,
+		`finalize dnssec_validate ` + file + ` ` + file,
+		`finalize dnssec_validate ` + filepath.Join(t.TempDir(), "missing"),
+	} {
+		c = caddy.NewTestController("dns", cfg)
+		if _, err := parse(c); err == nil {
+			t.Fatalf("Expected errors for %q, but got: %v", cfg, err)
+		}
+	}
+}
+
+func TestSetupECS(t *testing.T) {
+	c := caddy.NewTestController("dns", `finalize ecs synthesize 20 48`)
+	f, err := parse(c)
+	if err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if *f.ecs != (ecsPolicy{mode: ecsSynthesize, prefixV4: 20, prefixV6: 48}) {
+		t.Fatalf("Expected ecs synthesize 20 48, got %+v", f.ecs)
+	}
+
+	c = caddy.NewTestController("dns", `finalize ecs forward`)
+	f, err = parse(c)
+	if err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if *f.ecs != (ecsPolicy{mode: ecsForward, prefixV4: defaultECSPrefixV4, prefixV6: defaultECSPrefixV6}) {
+		t.Fatalf("Expected ecs forward with default prefixes, got %+v", f.ecs)
+	}
+
+	for _, cfg := range []string{
+		`finalize ecs`,
+		`finalize ecs copy`,
+		`finalize ecs strip 24`,
+		`finalize ecs forward 33`,
+		`finalize ecs forward 24 129`,
+		`finalize ecs forward 24 56 12`,
+	} {
+		c = caddy.NewTestController("dns", cfg)
+		if _, err := parse(c); err == nil {
+			t.Fatalf("Expected errors for %q, but got: %v", cfg, err)
+		}
+	}
 }
@@ -0,0 +1,50 @@
+package finalize
+
+import (
+	"context"
+	"time"
+
+	"github.com/coredns/coredns/plugin/metrics"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultStaleMaxAge is how long chains are served stale by default
+	// once their cache entry expired.
+	defaultStaleMaxAge = time.Hour
+	// defaultStaleTTL is the TTL of stale answers, as recommended by RFC 8767.
+	defaultStaleTTL = 30
+)
+
+// serveStale returns the result for a chain whose tail starting at target
+// couldn't be resolved, with failed being the result of the failure. If
+// serve_stale is enabled and the cache holds the tail, expired no longer than
+// the configured staleness ago, its records are returned with the stale TTL.
+// Requests with the CD bit set aren't served from the cache, so neither stale.
+func (s *Finalize) serveStale(ctx context.Context, state request.Request, failed result, target string, subnet *dns.EDNS0_SUBNET, authenticated bool) result {
+	if s.staleTTL == 0 || s.cache == nil || state.Req.CheckingDisabled {
+		return failed
+	}
+	item, ok := s.cache.getStale(target, state.QType(), subnet)
+	if !ok {
+		return failed
+	}
+	if s.dnssecPolicy == dnssecRefuse && item.signed {
+		return failed
+	}
+	staleAnswerCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+
+	log.Debugf("Serving stale answer for CNAME target=%s after outcome %s", target, failed.outcome)
+	return result{outcome: outcomeStale, answers: flattenAnswers(item.answers, state.QName(), s.staleTTL), authenticated: authenticated && item.authenticated}
+}
+
+// markStale adds the Extended DNS Error Stale Answer to r, if the client
+// supports EDNS0.
+func markStale(r *dns.Msg) {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeStaleAnswer})
+}
@@ -0,0 +1,131 @@
+package finalize
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// ednsCNAMEHandler answers like cnameHandler, keeping the OPT record of the
+// request.
+type ednsCNAMEHandler struct{}
+
+func (h ednsCNAMEHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Answer = []dns.RR{mustRR(r.Question[0].Name + " 60 IN CNAME bar.example.")}
+	if opt := r.IsEdns0(); opt != nil {
+		m.SetEdns0(opt.UDPSize(), opt.Do())
+	}
+
+	_ = w.WriteMsg(m)
+	return dns.RcodeSuccess, nil
+}
+
+func (h ednsCNAMEHandler) Name() string { return "ednscname" }
+
+// outageLookuper answers lookups with an A record, unless it is down. Then
+// lookups fail with an error or, if servfail is set, a SERVFAIL answer.
+type outageLookuper struct {
+	down     bool
+	servfail bool
+}
+
+func (l *outageLookuper) Lookup(ctx context.Context, state request.Request, name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.Response = true
+	if l.down {
+		if !l.servfail {
+			return nil, errors.New("connection refused")
+		}
+		m.Rcode = dns.RcodeServerFailure
+		return m, nil
+	}
+	m.Answer = []dns.RR{mustRR(name + " 300 IN A 203.0.113.10")}
+	return m, nil
+}
+
+func TestFinalizeServeStale(t *testing.T) {
+	tests := []struct {
+		name     string
+		servfail bool
+		staleTTL uint32
+		elapsed  time.Duration
+		stale    bool
+	}{
+		{name: "upstream error", staleTTL: 30, elapsed: 10 * time.Minute, stale: true},
+		{name: "servfail", servfail: true, staleTTL: 30, elapsed: 10 * time.Minute, stale: true},
+		{name: "too stale", staleTTL: 30, elapsed: 2 * time.Hour},
+		{name: "disabled", elapsed: 10 * time.Minute},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			upstream := &outageLookuper{servfail: tc.servfail}
+			finalize := New()
+			finalize.Next = ednsCNAMEHandler{}
+			finalize.upstream = upstream
+			finalize.cache = newChainCache(16, defaultCacheMaxTTL)
+			finalize.cache.stale = time.Hour
+			finalize.staleTTL = tc.staleTTL
+			now := time.Now()
+			finalize.cache.now = func() time.Time { return now }
+
+			query := func() *dns.Msg {
+				req := new(dns.Msg)
+				req.SetQuestion("foo.example.", dns.TypeA)
+				req.SetEdns0(dns.DefaultMsgSize, false)
+
+				w := newCaptureResponseWriter()
+				if _, err := finalize.ServeDNS(context.Background(), w, req); err != nil {
+					t.Fatalf("finalize ServeDNS failed: %v", err)
+				}
+				if w.msg == nil {
+					t.Fatal("expected finalize to write a response")
+				}
+				return w.msg
+			}
+
+			if m := query(); !allAnswersType(m.Answer, dns.TypeA) || staleEDE(m) {
+				t.Fatalf("expected fresh flattened answer, got: %v", m)
+			}
+
+			upstream.down = true
+			now = now.Add(tc.elapsed)
+			m := query()
+			if !tc.stale {
+				if !allAnswersType(m.Answer, dns.TypeCNAME) || staleEDE(m) {
+					t.Fatalf("expected the original answer, got: %v", m)
+				}
+				return
+			}
+			if !allAnswersType(m.Answer, dns.TypeA) {
+				t.Fatalf("expected stale flattened answer, got: %v", m.Answer)
+			}
+			if got := m.Answer[0].Header().Ttl; got != tc.staleTTL {
+				t.Fatalf("expected stale TTL %d, got %d", tc.staleTTL, got)
+			}
+			if !staleEDE(m) {
+				t.Fatalf("expected Extended DNS Error Stale Answer, got: %v", m.IsEdns0())
+			}
+		})
+	}
+}
+
+// staleEDE reports whether m carries the Extended DNS Error Stale Answer.
+func staleEDE(m *dns.Msg) bool {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	for _, o := range opt.Option {
+		if ede, ok := o.(*dns.EDNS0_EDE); ok && ede.InfoCode == dns.ExtendedErrorCodeStaleAnswer {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package finalize
+
+import (
+	"context"
+
+	"github.com/miekg/dns"
+	ot "github.com/opentracing/opentracing-go"
+	otext "github.com/opentracing/opentracing-go/ext"
+)
+
+// startChainSpan starts the span of resolving a chain as a child of the span
+// in ctx, if any, and returns the context carrying it.
+func startChainSpan(ctx context.Context, qname string, qtype uint16) (context.Context, ot.Span) {
+	span := ot.SpanFromContext(ctx)
+	if span == nil {
+		return ctx, nil
+	}
+	child := span.Tracer().StartSpan("finalize.chain", ot.ChildOf(span.Context()))
+	child.SetTag("finalize.qname", qname)
+	child.SetTag("finalize.qtype", dns.Type(qtype).String())
+	return ot.ContextWithSpan(ctx, child), child
+}
+
+// finishChainSpan records the result res of the chain on span and finishes
+// it.
+func finishChainSpan(span ot.Span, res result) {
+	if span == nil {
+		return
+	}
+	span.SetTag("finalize.outcome", string(res.outcome))
+	span.SetTag("finalize.hops", len(res.chain))
+	span.SetTag("finalize.lookups", res.lookups)
+	if res.outcome.failed() {
+		otext.Error.Set(span, true)
+	}
+	span.Finish()
+}
+
+// startHopSpan starts the span of the hop to target as a child of the span in
+// ctx, if any, and returns the context carrying it.
+func startHopSpan(ctx context.Context, target string, qtype uint16, source string) (context.Context, ot.Span) {
+	span := ot.SpanFromContext(ctx)
+	if span == nil {
+		return ctx, nil
+	}
+	child := span.Tracer().StartSpan("finalize.hop", ot.ChildOf(span.Context()))
+	child.SetTag("finalize.target", target)
+	child.SetTag("finalize.qtype", dns.Type(qtype).String())
+	child.SetTag("finalize.source", source)
+	return ot.ContextWithSpan(ctx, child), child
+}
+
+// finishHopSpan records the response msg of a hop, or the error err looking
+// it up, on span and finishes it.
+func finishHopSpan(span ot.Span, msg *dns.Msg, err error) {
+	if span == nil {
+		return
+	}
+	if err != nil {
+		otext.Error.Set(span, true)
+		span.LogKV("error", err.Error())
+	} else if msg != nil {
+		span.SetTag("finalize.rcode", dns.RcodeToString[msg.Rcode])
+		span.SetTag("finalize.answers", len(msg.Answer))
+	}
+	span.Finish()
+}
+
+// traceOriginalHops records a span for each hop of link, taken from the
+// answer orig for the query name. source tells whether orig is the original
+// answer or was looked up again via upstream.
+func traceOriginalHops(ctx context.Context, orig *dns.Msg, link chainLink, qtype uint16, source string) {
+	if ot.SpanFromContext(ctx) == nil {
+		return
+	}
+	for i, hop := range link.hops {
+		target := hop.Header().Name
+		if i < len(link.targets) {
+			target = link.targets[i]
+		}
+		_, span := startHopSpan(ctx, target, qtype, source)
+		finishHopSpan(span, orig, nil)
+	}
+}
+
+// traceCachedHop records a span for the hop to target, answered by the cache
+// entry item.
+func traceCachedHop(ctx context.Context, target string, qtype uint16, item *cacheItem) {
+	_, span := startHopSpan(ctx, target, qtype, hopSourceCache)
+	if span == nil {
+		return
+	}
+	span.SetTag("finalize.answers", len(item.answers))
+	span.Finish()
+}
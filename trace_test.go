@@ -0,0 +1,151 @@
+package finalize
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
+	ot "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+)
+
+func TestFinalizeTracing(t *testing.T) {
+	finalize := New()
+	finalize.Next = cnameHandler{}
+	finalize.upstream = &countingLookuper{}
+	finalize.cache = newChainCache(16, defaultCacheMaxTTL)
+
+	tests := []struct {
+		name   string
+		source string
+	}{
+		{name: "upstream", source: hopSourceUpstream},
+		{name: "cache", source: hopSourceCache},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tracer := mocktracer.New()
+			root := tracer.StartSpan("test")
+			ctx := ot.ContextWithSpan(context.Background(), root)
+
+			req := new(dns.Msg)
+			req.SetQuestion("foo.example.", dns.TypeA)
+			if _, err := finalize.ServeDNS(ctx, newCaptureResponseWriter(), req); err != nil {
+				t.Fatalf("finalize ServeDNS failed: %v", err)
+			}
+
+			// Spans of other plugins, like the one of the next plugin, are
+			// ignored.
+			var spans []*mocktracer.MockSpan
+			for _, span := range tracer.FinishedSpans() {
+				if strings.HasPrefix(span.OperationName, "finalize.") {
+					spans = append(spans, span)
+				}
+			}
+			if len(spans) != 3 {
+				t.Fatalf("expected a chain span and two hop spans, got %d spans", len(spans))
+			}
+			var chain *mocktracer.MockSpan
+			for _, span := range spans {
+				if span.OperationName == "finalize.chain" {
+					chain = span
+				}
+			}
+			if chain == nil {
+				t.Fatal("expected a finalize.chain span")
+			}
+			if chain.ParentID != root.(*mocktracer.MockSpan).SpanContext.SpanID {
+				t.Fatal("expected the chain span to be a child of the span in the context")
+			}
+			if got := chain.Tag("finalize.outcome"); got != string(outcomeFlattened) {
+				t.Fatalf("expected chain outcome %s, got %v", outcomeFlattened, got)
+			}
+
+			var hops []*mocktracer.MockSpan
+			for _, span := range spans {
+				if span.OperationName == "finalize.hop" {
+					if span.ParentID != chain.SpanContext.SpanID {
+						t.Fatal("expected the hop spans to be children of the chain span")
+					}
+					hops = append(hops, span)
+				}
+			}
+			if len(hops) != 2 {
+				t.Fatalf("expected two hop spans, got %d", len(hops))
+			}
+			if got := hops[0].Tag("finalize.source"); got != hopSourceOriginal {
+				t.Fatalf("expected the first hop from the original answer, got %v", got)
+			}
+			if got := hops[0].Tag("finalize.target"); got != "bar.example." {
+				t.Fatalf("expected the first hop to target bar.example., got %v", got)
+			}
+			if got := hops[1].Tag("finalize.source"); got != tc.source {
+				t.Fatalf("expected the second hop from %s, got %v", tc.source, got)
+			}
+			if got := hops[1].Tag("finalize.answers"); got != 1 {
+				t.Fatalf("expected one answer for the second hop, got %v", got)
+			}
+			if tc.source == hopSourceUpstream {
+				if got := hops[1].Tag("finalize.rcode"); got != "NOERROR" {
+					t.Fatalf("expected rcode NOERROR for the second hop, got %v", got)
+				}
+			}
+		})
+	}
+}
+
+func TestFinalizeTracingSignedLookup(t *testing.T) {
+	upstream, zone := newSignedChain(t, false)
+	cfg := &dnsserver.Config{
+		Zone:        ".",
+		ListenHosts: []string{""},
+		Port:        "53",
+		Plugin: []plugin.Plugin{
+			func(next plugin.Handler) plugin.Handler {
+				return upstream
+			},
+		},
+	}
+	server, err := dnsserver.NewServer("dns://:53", []*dnsserver.Config{cfg})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	finalize := New()
+	finalize.Next = upstream
+	finalize.anchors = map[string][]dns.RR{".": {zone.key}}
+
+	tracer := mocktracer.New()
+	root := tracer.StartSpan("test")
+	ctx := ot.ContextWithSpan(context.Background(), root)
+	ctx = context.WithValue(ctx, dnsserver.Key{}, server)
+	ctx = context.WithValue(ctx, dnsserver.LoopKey{}, 0)
+
+	// The client doesn't set the DO bit, so the query name is looked up
+	// again and none of the hops are taken from the original answer.
+	req := new(dns.Msg)
+	req.SetQuestion("foo.example.", dns.TypeA)
+	if _, err := finalize.ServeDNS(ctx, newCaptureResponseWriter(), req); err != nil {
+		t.Fatalf("finalize ServeDNS failed: %v", err)
+	}
+
+	var targets []string
+	for _, span := range tracer.FinishedSpans() {
+		if span.OperationName != "finalize.hop" {
+			continue
+		}
+		if got := span.Tag("finalize.source"); got != hopSourceUpstream {
+			t.Fatalf("expected the hop to %v from %s, got %v", span.Tag("finalize.target"), hopSourceUpstream, got)
+		}
+		targets = append(targets, span.Tag("finalize.target").(string))
+	}
+	// The lookup of the query name, the hop it answered and the lookups of
+	// the targets.
+	if want := []string{"foo.example.", "bar.example.", "bar.example.", "baz.example."}; !slices.Equal(targets, want) {
+		t.Fatalf("expected hops to %v, got %v", want, targets)
+	}
+}
@@ -0,0 +1,124 @@
+package finalize
+
+import (
+	"github.com/miekg/dns"
+)
+
+// chainTTLs tracks the TTLs seen while walking a chain. A TTL of 0 is a valid
+// TTL, seen tells whether any record was added at all.
+type chainTTLs struct {
+	seen bool
+	min  uint32
+	max  uint32
+	// first is the TTL of the alias owned by the query name, last the
+	// minimum TTL of the terminal records.
+	first uint32
+	last  uint32
+}
+
+// addHops adds the TTLs of the aliases rrs, in chain order.
+func (t *chainTTLs) addHops(rrs []dns.RR) {
+	for _, rr := range rrs {
+		if !t.seen {
+			t.first = rr.Header().Ttl
+		}
+		t.add(rr.Header().Ttl)
+	}
+}
+
+// addTerminal adds the TTLs of the terminal records rrs.
+func (t *chainTTLs) addTerminal(rrs []dns.RR) {
+	for i, rr := range rrs {
+		ttl := rr.Header().Ttl
+		if i == 0 || ttl < t.last {
+			t.last = ttl
+		}
+		t.add(ttl)
+	}
+}
+
+// merge adds the TTLs of the chain tail u, which follows the records added
+// to t so far.
+func (t *chainTTLs) merge(u chainTTLs) {
+	if !u.seen {
+		return
+	}
+	if !t.seen {
+		t.first = u.first
+	}
+	t.add(u.min)
+	t.add(u.max)
+	t.last = u.last
+}
+
+func (t *chainTTLs) add(ttl uint32) {
+	if !t.seen || ttl < t.min {
+		t.min = ttl
+	}
+	if !t.seen || ttl > t.max {
+		t.max = ttl
+	}
+	t.seen = true
+}
+
+// decay returns the TTLs reduced by elapsed seconds, keeping at least 1.
+func (t chainTTLs) decay(elapsed uint32) chainTTLs {
+	t.min = decayTTL(t.min, elapsed)
+	t.max = decayTTL(t.max, elapsed)
+	t.first = decayTTL(t.first, elapsed)
+	t.last = decayTTL(t.last, elapsed)
+	return t
+}
+
+// decayTTL returns ttl reduced by elapsed seconds, keeping at least 1.
+func decayTTL(ttl, elapsed uint32) uint32 {
+	if ttl <= elapsed {
+		return 1
+	}
+	return ttl - elapsed
+}
+
+const (
+	ttlMin   = "min"
+	ttlMax   = "max"
+	ttlFirst = "first"
+	ttlLast  = "last"
+	ttlFixed = "fixed"
+)
+
+// ttlPolicy selects the TTL of flattened answers from the TTLs of the chain.
+type ttlPolicy struct {
+	mode  string
+	fixed uint32
+	// floor and ceiling clamp the selected TTL; a ceiling of 0 means no
+	// upper limit.
+	floor   uint32
+	ceiling uint32
+}
+
+// defaultTTLPolicy uses the minimum TTL of the chain.
+var defaultTTLPolicy = ttlPolicy{mode: ttlMin}
+
+// apply returns the TTL of the flattened answers of a chain with TTLs t.
+func (p ttlPolicy) apply(t chainTTLs) uint32 {
+	var ttl uint32
+	switch p.mode {
+	case ttlMax:
+		ttl = t.max
+	case ttlFirst:
+		ttl = t.first
+	case ttlLast:
+		ttl = t.last
+	case ttlFixed:
+		ttl = p.fixed
+	default:
+		ttl = t.min
+	}
+	if ttl < p.floor {
+		ttl = p.floor
+	}
+	if p.ceiling > 0 && ttl > p.ceiling {
+		ttl = p.ceiling
+	}
+	return ttl
+}
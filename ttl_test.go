@@ -0,0 +1,114 @@
+package finalize
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
+)
+
+func TestTTLPolicy(t *testing.T) {
+	ttls := chainTTLs{}
+	ttls.addHops([]dns.RR{
+		mustRR("foo.example. 5 IN CNAME bar.example."),
+		mustRR("bar.example. 300 IN CNAME baz.example."),
+	})
+	ttls.addTerminal([]dns.RR{
+		mustRR("baz.example. 3600 IN A 203.0.113.10"),
+		mustRR("baz.example. 1800 IN A 203.0.113.11"),
+	})
+
+	tests := []struct {
+		name     string
+		policy   ttlPolicy
+		expected uint32
+	}{
+		{name: "min", policy: ttlPolicy{mode: ttlMin}, expected: 5},
+		{name: "max", policy: ttlPolicy{mode: ttlMax}, expected: 3600},
+		{name: "first", policy: ttlPolicy{mode: ttlFirst}, expected: 5},
+		{name: "last", policy: ttlPolicy{mode: ttlLast}, expected: 1800},
+		{name: "fixed", policy: ttlPolicy{mode: ttlFixed, fixed: 120}, expected: 120},
+		{name: "floor", policy: ttlPolicy{mode: ttlMin, floor: 60}, expected: 60},
+		{name: "ceiling", policy: ttlPolicy{mode: ttlMax, ceiling: 900}, expected: 900},
+		{name: "within clamps", policy: ttlPolicy{mode: ttlLast, floor: 60, ceiling: 3600}, expected: 1800},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.policy.apply(ttls); got != tc.expected {
+				t.Fatalf("expected TTL %d, got %d", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestChainTTLsZero(t *testing.T) {
+	ttls := chainTTLs{}
+	ttls.addHops([]dns.RR{mustRR("foo.example. 0 IN CNAME bar.example.")})
+	ttls.addTerminal([]dns.RR{mustRR("bar.example. 60 IN A 203.0.113.10")})
+
+	if got := defaultTTLPolicy.apply(ttls); got != 0 {
+		t.Fatalf("expected a chain TTL of 0 to be kept, got %d", got)
+	}
+	if ttls.first != 0 || ttls.last != 60 || ttls.max != 60 {
+		t.Fatalf("unexpected chain TTLs %+v", ttls)
+	}
+}
+
+func TestFinalizeTTLPolicy(t *testing.T) {
+	capture := &ttlAwareCaptureHandler{}
+	cfg := &dnsserver.Config{
+		Zone:        ".",
+		ListenHosts: []string{""},
+		Port:        "53",
+		Plugin: []plugin.Plugin{
+			func(next plugin.Handler) plugin.Handler {
+				return capture
+			},
+		},
+	}
+	server, err := dnsserver.NewServer("dns://:53", []*dnsserver.Config{cfg})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	ctx := context.WithValue(context.Background(), dnsserver.Key{}, server)
+	ctx = context.WithValue(ctx, dnsserver.LoopKey{}, 0)
+
+	// The chain is foo.example. (CNAME 5s) -> bar.example. (CNAME 300s) ->
+	// baz.example. (A 3600s).
+	tests := []struct {
+		name     string
+		policy   ttlPolicy
+		expected uint32
+	}{
+		{name: "min", policy: defaultTTLPolicy, expected: 5},
+		{name: "max", policy: ttlPolicy{mode: ttlMax}, expected: 3600},
+		{name: "first", policy: ttlPolicy{mode: ttlFirst}, expected: 5},
+		{name: "last", policy: ttlPolicy{mode: ttlLast}, expected: 3600},
+		{name: "fixed", policy: ttlPolicy{mode: ttlFixed, fixed: 120}, expected: 120},
+		{name: "min with floor", policy: ttlPolicy{mode: ttlMin, floor: 60}, expected: 60},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			finalize := New()
+			finalize.Next = &ttlAwareCnameHandler{ttl: 5}
+			finalize.ttl = tc.policy
+
+			req := new(dns.Msg)
+			req.SetQuestion("foo.example.", dns.TypeA)
+
+			w := newCaptureResponseWriter()
+			if _, err := finalize.ServeDNS(ctx, w, req); err != nil {
+				t.Fatalf("finalize ServeDNS failed: %v", err)
+			}
+			if w.msg == nil || countRRType(w.msg.Answer, dns.TypeA) != 1 {
+				t.Fatalf("expected one A record, got: %v", w.msg)
+			}
+			if got := w.msg.Answer[0].Header().Ttl; got != tc.expected {
+				t.Fatalf("expected TTL %d, got %d", tc.expected, got)
+			}
+		})
+	}
+}
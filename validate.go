@@ -0,0 +1,260 @@
+package finalize
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// maxValidationDepth limits the number of zones walked up from a signer to a
+// trust anchor.
+const maxValidationDepth = 16
+
+// readTrustAnchors reads the DS and DNSKEY records of the trust anchors from
+// the zone file formatted file, keyed by their lower cased owner.
+func readTrustAnchors(file string) (map[string][]dns.RR, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	anchors := map[string][]dns.RR{}
+	zp := dns.NewZoneParser(f, ".", file)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		switch rr.Header().Rrtype {
+		case dns.TypeDS, dns.TypeDNSKEY:
+			owner := strings.ToLower(rr.Header().Name)
+			anchors[owner] = append(anchors[owner], rr)
+		default:
+			return nil, fmt.Errorf("trust anchor %s in %s is neither DS nor DNSKEY", rr.Header().Name, file)
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	if len(anchors) == 0 {
+		return nil, fmt.Errorf("no trust anchors found in %s", file)
+	}
+	return anchors, nil
+}
+
+// validation validates the RRsets of a single chain against the trust
+// anchors. The DNSKEY and DS records are looked up like the chain itself,
+// the keys of zones already validated are remembered.
+type validation struct {
+	s *Finalize
+	// state is the client request with the DO bit set, so lookups return
+	// signatures.
+	state request.Request
+	keys  map[string][]*dns.DNSKEY
+	now   time.Time
+}
+
+func (s *Finalize) newValidation(state request.Request) *validation {
+	req := state.Req.Copy()
+	if opt := req.IsEdns0(); opt != nil {
+		opt.SetDo()
+	} else {
+		req.SetEdns0(dns.DefaultMsgSize, true)
+	}
+	return &validation{
+		s:     s,
+		state: request.Request{W: state.W, Req: req},
+		keys:  map[string][]*dns.DNSKEY{},
+		now:   time.Now(),
+	}
+}
+
+// validateLink validates the hops of link and its terminal records against
+// the signatures in msg, the response link was taken from. A CNAME without
+// signatures is accepted if it was synthesized from a valid DNAME.
+func (v *validation) validateLink(ctx context.Context, msg *dns.Msg, link chainLink) error {
+	for _, hop := range link.hops {
+		rrset, sigs := rrsetOf(msg.Answer, hop.Header().Name, hop.Header().Rrtype)
+		if len(sigs) == 0 && hop.Header().Rrtype == dns.TypeCNAME {
+			if dname := synthesizingDNAME(msg.Answer, hop.(*dns.CNAME)); dname != nil {
+				rrset, sigs = rrsetOf(msg.Answer, dname.Hdr.Name, dns.TypeDNAME)
+			}
+		}
+		if err := v.verify(ctx, rrset, sigs, 0); err != nil {
+			return err
+		}
+	}
+	if len(link.terminal) > 0 {
+		rrset, sigs := rrsetOf(msg.Answer, link.terminal[0].Header().Name, link.terminal[0].Header().Rrtype)
+		if err := v.verify(ctx, rrset, sigs, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verify checks that one of sigs is a valid signature of rrset made by a key
+// of a zone which validates up to a trust anchor.
+func (v *validation) verify(ctx context.Context, rrset []dns.RR, sigs []*dns.RRSIG, depth int) error {
+	if len(rrset) == 0 {
+		return errors.New("no records to validate")
+	}
+	owner := rrset[0].Header().Name
+	rtype := dns.Type(rrset[0].Header().Rrtype).String()
+	if len(sigs) == 0 {
+		return fmt.Errorf("no signatures for %s %s", owner, rtype)
+	}
+
+	err := fmt.Errorf("no valid signature for %s %s", owner, rtype)
+	for _, sig := range sigs {
+		if !sig.ValidityPeriod(v.now) || !dns.IsSubDomain(sig.SignerName, owner) {
+			continue
+		}
+		// A DS record is signed by the parent zone.
+		if rrset[0].Header().Rrtype == dns.TypeDS && strings.EqualFold(sig.SignerName, owner) {
+			continue
+		}
+		keys, kerr := v.zoneKeys(ctx, sig.SignerName, depth+1)
+		if kerr != nil {
+			err = kerr
+			continue
+		}
+		if verifySignature(sig, keys, rrset) {
+			return nil
+		}
+	}
+	return err
+}
+
+// zoneKeys returns the DNSKEY records of zone once the DNSKEY RRset has been
+// validated, either directly against a trust anchor of the zone or against
+// the DS records of its parent.
+func (v *validation) zoneKeys(ctx context.Context, zone string, depth int) ([]*dns.DNSKEY, error) {
+	zone = strings.ToLower(zone)
+	if keys, ok := v.keys[zone]; ok {
+		return keys, nil
+	}
+	if depth > maxValidationDepth {
+		return nil, fmt.Errorf("no trust anchor found within %d zones of %s", maxValidationDepth, zone)
+	}
+
+	resp, err := v.s.lookup(ctx, v.state, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	keySet, keySigs := rrsetOf(resp.Answer, zone, dns.TypeDNSKEY)
+	keys := make([]*dns.DNSKEY, 0, len(keySet))
+	for _, rr := range keySet {
+		keys = append(keys, rr.(*dns.DNSKEY))
+	}
+
+	anchors, ok := v.s.anchors[zone]
+	if !ok {
+		resp, err := v.s.lookup(ctx, v.state, zone, dns.TypeDS)
+		if err != nil {
+			return nil, err
+		}
+		dsSet, dsSigs := rrsetOf(resp.Answer, zone, dns.TypeDS)
+		if len(dsSet) == 0 {
+			return nil, fmt.Errorf("no DS records for %s", zone)
+		}
+		if err := v.verify(ctx, dsSet, dsSigs, depth); err != nil {
+			return nil, err
+		}
+		anchors = dsSet
+	}
+
+	trusted := trustedKeys(keys, anchors)
+	if len(trusted) == 0 {
+		return nil, fmt.Errorf("no DNSKEY of %s matches its trust anchors", zone)
+	}
+	for _, sig := range keySigs {
+		if sig.ValidityPeriod(v.now) && verifySignature(sig, trusted, keySet) {
+			v.keys[zone] = keys
+			return keys, nil
+		}
+	}
+	return nil, fmt.Errorf("no valid signature for %s DNSKEY", zone)
+}
+
+// verifySignature reports whether sig is a valid signature of rrset made by
+// one of keys.
+func verifySignature(sig *dns.RRSIG, keys []*dns.DNSKEY, rrset []dns.RR) bool {
+	for _, key := range keys {
+		if key.Algorithm != sig.Algorithm || key.KeyTag() != sig.KeyTag || !strings.EqualFold(key.Hdr.Name, sig.SignerName) {
+			continue
+		}
+		if sig.Verify(key, rrset) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// trustedKeys returns the keys matching one of the DS or DNSKEY anchors.
+func trustedKeys(keys []*dns.DNSKEY, anchors []dns.RR) []*dns.DNSKEY {
+	var trusted []*dns.DNSKEY
+	for _, key := range keys {
+		for _, anchor := range anchors {
+			if keyMatches(key, anchor) {
+				trusted = append(trusted, key)
+				break
+			}
+		}
+	}
+	return trusted
+}
+
+func keyMatches(key *dns.DNSKEY, anchor dns.RR) bool {
+	switch a := anchor.(type) {
+	case *dns.DS:
+		if a.KeyTag != key.KeyTag() || a.Algorithm != key.Algorithm {
+			return false
+		}
+		ds := key.ToDS(a.DigestType)
+		return ds != nil && strings.EqualFold(ds.Digest, a.Digest)
+	case *dns.DNSKEY:
+		return a.Flags == key.Flags && a.Protocol == key.Protocol && a.Algorithm == key.Algorithm && a.PublicKey == key.PublicKey
+	}
+	return false
+}
+
+// rrsetOf returns the records of type rtype owned by name and the signatures
+// covering them.
+func rrsetOf(rrs []dns.RR, name string, rtype uint16) ([]dns.RR, []*dns.RRSIG) {
+	var rrset []dns.RR
+	var sigs []*dns.RRSIG
+	for _, rr := range rrs {
+		if !strings.EqualFold(rr.Header().Name, name) {
+			continue
+		}
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			if sig.TypeCovered == rtype {
+				sigs = append(sigs, sig)
+			}
+			continue
+		}
+		if rr.Header().Rrtype == rtype {
+			rrset = append(rrset, rr)
+		}
+	}
+	return rrset, sigs
+}
+
+// synthesizingDNAME returns the DNAME in rrs from which cname was
+// synthesized, if any.
+func synthesizingDNAME(rrs []dns.RR, cname *dns.CNAME) *dns.DNAME {
+	for _, rr := range rrs {
+		dname, ok := rr.(*dns.DNAME)
+		if !ok {
+			continue
+		}
+		if target, ok := aliasTarget(dname, cname.Hdr.Name); ok && strings.EqualFold(target, cname.Target) {
+			return dname
+		}
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+package finalize
+
+import (
+	"context"
+	"crypto"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
+)
+
+// testZone is a zone signing key used to sign the records of a test zone.
+type testZone struct {
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newTestZone(t *testing.T, name string) *testZone {
+	t.Helper()
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatalf("failed to generate key for %s: %v", name, err)
+	}
+	return &testZone{key: key, priv: priv.(crypto.Signer)}
+}
+
+func (z *testZone) sign(t *testing.T, rrset ...dns.RR) *dns.RRSIG {
+	t.Helper()
+	now := time.Now()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: rrset[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: rrset[0].Header().Ttl},
+		Algorithm:  z.key.Algorithm,
+		KeyTag:     z.key.KeyTag(),
+		SignerName: z.key.Hdr.Name,
+		Inception:  uint32(now.Add(-time.Hour).Unix()),
+		Expiration: uint32(now.Add(time.Hour).Unix()),
+	}
+	if err := sig.Sign(z.priv, rrset); err != nil {
+		t.Fatalf("failed to sign %s: %v", rrset[0].Header().Name, err)
+	}
+	return sig
+}
+
+// signedZoneHandler serves signed RRsets, keyed by owner and type. CNAMEs are
+// returned for all types of their owner, signatures only if the DO bit is
+// set. The AD bit is never set.
+type signedZoneHandler struct {
+	rrsets map[string][]dns.RR
+}
+
+func (h *signedZoneHandler) add(rrset ...dns.RR) {
+	key := strings.ToLower(rrset[0].Header().Name) + "/" + dns.Type(rrset[0].Header().Rrtype).String()
+	if sig, ok := rrset[0].(*dns.RRSIG); ok {
+		key = strings.ToLower(sig.Hdr.Name) + "/" + dns.Type(sig.TypeCovered).String()
+	}
+	h.rrsets[key] = append(h.rrsets[key], rrset...)
+}
+
+func (h *signedZoneHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+
+	q := r.Question[0]
+	rrs, ok := h.rrsets[strings.ToLower(q.Name)+"/"+dns.Type(q.Qtype).String()]
+	if !ok {
+		rrs = h.rrsets[strings.ToLower(q.Name)+"/CNAME"]
+	}
+	do := r.IsEdns0() != nil && r.IsEdns0().Do()
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeRRSIG && !do {
+			continue
+		}
+		m.Answer = append(m.Answer, rr)
+	}
+
+	_ = w.WriteMsg(m)
+	return dns.RcodeSuccess, nil
+}
+
+func (h *signedZoneHandler) Name() string { return "signedZone" }
+
+// newSignedChain returns the zones . and example., with example. delegated
+// securely from the root, serving the chain foo.example. -> bar.example. ->
+// baz.example. If tamper is set, the A record of baz.example. doesn't match
+// its signature.
+func newSignedChain(t *testing.T, tamper bool) (*signedZoneHandler, *testZone) {
+	t.Helper()
+	root := newTestZone(t, ".")
+	example := newTestZone(t, "example.")
+	h := &signedZoneHandler{rrsets: map[string][]dns.RR{}}
+
+	h.add(root.key, root.sign(t, root.key))
+	ds := example.key.ToDS(dns.SHA256)
+	ds.Hdr.Ttl = 3600
+	h.add(ds, root.sign(t, ds))
+	h.add(example.key, example.sign(t, example.key))
+
+	for _, rr := range []dns.RR{
+		mustRR("foo.example. 60 IN CNAME bar.example."),
+		mustRR("bar.example. 60 IN CNAME baz.example."),
+	} {
+		h.add(rr, example.sign(t, rr))
+	}
+	a := mustRR("baz.example. 60 IN A 203.0.113.10")
+	sig := example.sign(t, a)
+	if tamper {
+		a = mustRR("baz.example. 60 IN A 198.51.100.66")
+	}
+	h.add(a, sig)
+
+	return h, root
+}
+
+func TestFinalizeValidatesChain(t *testing.T) {
+	tests := []struct {
+		name    string
+		tamper  bool
+		anchor  func(root *testZone) map[string][]dns.RR
+		rcode   int
+		answerA bool
+	}{
+		{
+			name:    "valid",
+			anchor:  func(root *testZone) map[string][]dns.RR { return map[string][]dns.RR{".": {root.key}} },
+			rcode:   dns.RcodeSuccess,
+			answerA: true,
+		},
+		{
+			name:   "tampered",
+			tamper: true,
+			anchor: func(root *testZone) map[string][]dns.RR { return map[string][]dns.RR{".": {root.key}} },
+			rcode:  dns.RcodeServerFailure,
+		},
+		{
+			name: "untrusted root",
+			anchor: func(root *testZone) map[string][]dns.RR {
+				return map[string][]dns.RR{".": {newTestZone(t, ".").key}}
+			},
+			rcode: dns.RcodeServerFailure,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			upstream, root := newSignedChain(t, tc.tamper)
+			cfg := &dnsserver.Config{
+				Zone:        ".",
+				ListenHosts: []string{""},
+				Port:        "53",
+				Plugin: []plugin.Plugin{
+					func(next plugin.Handler) plugin.Handler {
+						return upstream
+					},
+				},
+			}
+			server, err := dnsserver.NewServer("dns://:53", []*dnsserver.Config{cfg})
+			if err != nil {
+				t.Fatalf("failed to create server: %v", err)
+			}
+			ctx := context.WithValue(context.Background(), dnsserver.Key{}, server)
+			ctx = context.WithValue(ctx, dnsserver.LoopKey{}, 0)
+
+			finalize := New()
+			finalize.Next = upstream
+			finalize.anchors = tc.anchor(root)
+			finalize.onFailure = map[outcome]int{outcomeBogus: dns.RcodeServerFailure}
+
+			// The client doesn't set the DO bit, so the signed answer for
+			// the query name is looked up again.
+			req := new(dns.Msg)
+			req.SetQuestion("foo.example.", dns.TypeA)
+
+			w := newCaptureResponseWriter()
+			if _, err := finalize.ServeDNS(ctx, w, req); err != nil {
+				t.Fatalf("finalize ServeDNS failed: %v", err)
+			}
+			if w.msg == nil {
+				t.Fatal("expected finalize to write a response")
+			}
+			if w.msg.Rcode != tc.rcode {
+				t.Fatalf("expected rcode %s, got %s", dns.RcodeToString[tc.rcode], dns.RcodeToString[w.msg.Rcode])
+			}
+			if !tc.answerA {
+				return
+			}
+			if !allAnswersType(w.msg.Answer, dns.TypeA) || !w.msg.Answer[0].(*dns.A).A.Equal(net.ParseIP("203.0.113.10")) {
+				t.Fatalf("expected the validated A record, got: %v", w.msg.Answer)
+			}
+			if w.msg.Answer[0].Header().Name != "foo.example." {
+				t.Fatalf("expected the A record to be flattened, got: %v", w.msg.Answer)
+			}
+			if !w.msg.AuthenticatedData {
+				t.Fatal("expected the validated answer to be authenticated")
+			}
+		})
+	}
+}
+
+func TestReadTrustAnchors(t *testing.T) {
+	root := newTestZone(t, ".")
+	example := newTestZone(t, "example.")
+	dir := t.TempDir()
+
+	file := filepath.Join(dir, "anchors")
+	content := root.key.String() + "\n" + example.key.ToDS(dns.SHA256).String() + "\n"
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	anchors, err := readTrustAnchors(file)
+	if err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if len(anchors["."]) != 1 || len(anchors["example."]) != 1 {
+		t.Fatalf("Expected anchors for . and example., got %v", anchors)
+	}
+
+	invalid := filepath.Join(dir, "invalid")
+	if err := os.WriteFile(invalid, []byte("example. 60 IN A 203.0.113.10\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readTrustAnchors(invalid); err == nil {
+		t.Fatal("Expected errors for records other than DS and DNSKEY")
+	}
+	if _, err := readTrustAnchors(filepath.Join(dir, "missing")); err == nil {
+		t.Fatal("Expected errors for a missing file")
+	}
+}